@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/RoundRobinHood/jouma-data-migration/syncing"
+	"github.com/RoundRobinHood/jouma-data-migration/wp"
+)
+
+func runCleanupMedia(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("cleanup-media", flag.ExitOnError)
+	doDelete := flags.Bool("delete", false, "Delete the orphaned attachments (default is a dry run)")
+	author := flags.Int("author", 0, "User ID that uploaded the synced images (defaults to the application user)")
+	unmarked := flags.Bool("include-unmarked", false, "Also consider attachments by the author that the sync didn't mark as imported, such as images sideloaded before marking was added. Only use this if the author uploads nothing by hand")
+	applyTrafficLimits := trafficFlags(flags)
+	configureClients := clientFlags(flags)
+	flags.Parse(args)
+
+	applyTrafficLimits()
+	finishClients, err := configureClients()
+	defer finishClients()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid HTTP client settings:", err)
+		return
+	}
+
+	wp_config, wc_config, ok := siteConfigs()
+	if !ok {
+		return
+	}
+
+	if *author == 0 {
+		user, err := wp.GetCurrentUser(ctx, wp_config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to look up application user:", err)
+			return
+		}
+		*author = user.ID
+		fmt.Printf("Looking for images uploaded by %q (ID %d)\n", user.Name, user.ID)
+	}
+
+	orphans, err := syncing.FindOrphanedMedia(ctx, wp_config, wc_config, *author, *unmarked)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to find orphaned media:", err)
+		return
+	}
+
+	var total int64
+	for _, media := range orphans {
+		size := wp.MediaSize(media)
+		total += size
+		fmt.Printf("%d\t%s\t%s\n", media.ID, formatBytes(size), media.SourceURL)
+	}
+	fmt.Printf("%d orphaned attachments, %s in total\n", len(orphans), formatBytes(total))
+
+	if len(orphans) == 0 {
+		return
+	}
+	if !*doDelete {
+		fmt.Println("Dry run: nothing deleted. Pass -delete to remove these attachments.")
+		return
+	}
+
+	fmt.Println("Deleting orphaned attachments...")
+	for err := range syncing.DeleteMedia(ctx, wp_config, orphans) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func formatBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
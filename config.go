@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
+	"github.com/RoundRobinHood/jouma-data-migration/rest"
+	"github.com/RoundRobinHood/jouma-data-migration/supplier"
+	"github.com/RoundRobinHood/jouma-data-migration/syncing"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+)
+
+func requireEnv(name, description string) (string, bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		fmt.Fprintf(os.Stderr, "Please provide %s\n", description)
+		return "", false
+	}
+	return value, true
+}
+
+func siteConfigs() (wp_config, wc_config types.ApiConfig, ok bool) {
+	key, ok := requireEnv("WC_CONSUMER_KEY", "WC consumer key")
+	if !ok {
+		return
+	}
+	secret, ok := requireEnv("WC_CONSUMER_SECRET", "WC consumer secret")
+	if !ok {
+		return
+	}
+	wc_url, ok := requireEnv("APP_URL", "WP site url")
+	if !ok {
+		return
+	}
+	app_user, ok := requireEnv("APP_USER", "application username")
+	if !ok {
+		return
+	}
+	app_pass, ok := requireEnv("APP_PWD", "application password")
+	if !ok {
+		return
+	}
+
+	wc_auth, err := wcAuth(os.Getenv("WC_AUTH"), wc_url, key, secret)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return wp_config, wc_config, false
+	}
+	wc_config = types.ApiConfig{
+		BaseUrl: wc_url,
+		Auth:    wc_auth,
+	}
+
+	// Application passwords only support Basic auth
+	wp_config = types.ApiConfig{
+		BaseUrl: wc_url,
+		Auth:    rest.BasicAuth{Username: app_user, Password: app_pass},
+	}
+
+	return wp_config, wc_config, true
+}
+
+// WooCommerce auth method from WC_AUTH: 'basic', 'query' (for hosts that strip
+// the Authorization header) or 'oauth1'. WooCommerce only accepts OAuth over
+// plain HTTP, so that is the default for http:// sites.
+func wcAuth(method, site_url, key, secret string) (rest.Authenticator, error) {
+	if method == "" {
+		method = "basic"
+		if strings.HasPrefix(strings.ToLower(site_url), "http://") {
+			method = "oauth1"
+		}
+	}
+	switch strings.ToLower(method) {
+	case "basic":
+		return rest.BasicAuth{Username: key, Password: secret}, nil
+	case "query":
+		return rest.QueryAuth{ConsumerKey: key, ConsumerSecret: secret}, nil
+	case "oauth1", "oauth":
+		return rest.OAuth1{ConsumerKey: key, ConsumerSecret: secret}, nil
+	}
+	return nil, fmt.Errorf("Unknown WC_AUTH %q: expected 'basic', 'query' or 'oauth1'", method)
+}
+
+// The feed to sync from: the Tarsus JSON feed at path for 'api' and 'file', or
+// a CSV feed read as described by the JSON config at csvConfig for 'csv'.
+func feedSource(kind, path, csvConfig string) (supplier.Source, error) {
+	switch strings.ToLower(kind) {
+	case "api", "file":
+		return &supplier.Tarsus{Path: path}, nil
+	case "csv":
+		if csvConfig == "" {
+			return nil, fmt.Errorf("the csv source needs -csv-config")
+		}
+		cnf, err := supplier.LoadCSVConfig(csvConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %q: %w", csvConfig, err)
+		}
+		return supplier.NewCSV(path, cnf)
+	}
+	return nil, fmt.Errorf("unknown source %q: expected 'api', 'file' or 'csv'", kind)
+}
+
+// Additional supplier feeds, from a JSON file like:
+//
+//	[
+//	  {"type": "csv", "path": "acme.csv", "csv": {"supplier": "acme", "columns": {...}}},
+//	  {"type": "tarsus", "path": "tarsus-branch.json"}
+//	]
+func loadSuppliers(path string) ([]supplier.Source, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Type string             `json:"type"`
+		Path string             `json:"path"`
+		CSV  supplier.CSVConfig `json:"csv"`
+	}
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		return nil, err
+	}
+	sources := make([]supplier.Source, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Path == "" {
+			return nil, fmt.Errorf("supplier %d has no path", i+1)
+		}
+		switch strings.ToLower(entry.Type) {
+		case "tarsus":
+			sources = append(sources, &supplier.Tarsus{Path: entry.Path})
+		case "csv":
+			source, err := supplier.NewCSV(entry.Path, entry.CSV)
+			if err != nil {
+				return nil, fmt.Errorf("supplier %d: %w", i+1, err)
+			}
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("supplier %d has unknown type %q: expected 'tarsus' or 'csv'", i+1, entry.Type)
+		}
+	}
+	return sources, nil
+}
+
+func parseMediaTemplates(alt, title, caption string) (syncing.MediaTemplates, error) {
+	var templates syncing.MediaTemplates
+	fields := []struct {
+		name string
+		text string
+		dst  **template.Template
+	}{
+		{"alt", alt, &templates.AltText},
+		{"title", title, &templates.Title},
+		{"caption", caption, &templates.Caption},
+	}
+	for _, field := range fields {
+		if field.text == "" {
+			continue
+		}
+		tmpl, err := template.New(field.name).Option("missingkey=error").Parse(field.text)
+		if err != nil {
+			return templates, err
+		}
+		*field.dst = tmpl
+	}
+	return templates, nil
+}
+
+func loadPlaceholders(path string) error {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var placeholders map[string]int
+	if err := json.Unmarshal(bytes, &placeholders); err != nil {
+		return err
+	}
+	for manufacturer, id := range placeholders {
+		wc.PlaceholderImages[strings.ToLower(manufacturer)] = id
+	}
+	return nil
+}
+
+// Reads pinned product fields, keyed by SKU:
+//
+//	{"ABC123": {"name": "Local name", "price": 1299, "categories": ["Laptops"], "images": [{"id": 42}]}}
+func loadOverrides(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	// A misspelled field would silently not be pinned
+	decoder.DisallowUnknownFields()
+	var overrides map[string]wc.Override
+	if err := decoder.Decode(&overrides); err != nil {
+		return err
+	}
+	for sku, override := range overrides {
+		wc.Overrides[sku] = override
+	}
+	return nil
+}
+
+// Registers the rate and concurrency limit flags on flags. The returned
+// function applies them to the shared site limits once the flags are parsed.
+func trafficFlags(flags *flag.FlagSet) func() {
+	rate := flags.Float64("rate", 5, "Requests per second to the WP site, across all workers (0 for no limit)")
+	burst := flags.Int("burst", 5, "Requests that may be sent back-to-back before -rate applies")
+	readRate := flags.Float64("read-rate", 0, "Requests per second for GET requests (0 for only the overall limit)")
+	writeRate := flags.Float64("write-rate", 2, "Requests per second for product writes (0 for only the overall limit)")
+	mediaRate := flags.Float64("media-rate", 1, "Requests per second for media library requests (0 for only the overall limit)")
+	minConcurrency := flags.Int("min-concurrency", 1, "Fewest requests in flight to the WP site when it is struggling")
+	maxConcurrency := flags.Int("max-concurrency", 16, "Most requests in flight to the WP site when it is healthy")
+
+	return func() {
+		classBurst := func(rate float64) int { return max(1, int(rate)) }
+		rest.SiteLimiter.SetLimits(rest.Limit{PerSecond: *rate, Burst: *burst}, map[rest.EndpointClass]rest.Limit{
+			rest.ClassRead:  {PerSecond: *readRate, Burst: classBurst(*readRate)},
+			rest.ClassWrite: {PerSecond: *writeRate, Burst: classBurst(*writeRate)},
+			rest.ClassMedia: {PerSecond: *mediaRate, Burst: classBurst(*mediaRate)},
+		})
+		rest.SiteConcurrency.Min = max(1, *minConcurrency)
+		rest.SiteConcurrency.Max = max(rest.SiteConcurrency.Min, *maxConcurrency)
+	}
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Registers the HTTP client flags on flags, defaulting to the HTTP_* env
+// variables. The returned function configures the shared clients once the
+// flags are parsed. It returns a function to call when the run ends, which
+// writes out recorded traffic.
+func clientFlags(flags *flag.FlagSet) func() (func(), error) {
+	defaults := rest.DefaultClientConfig()
+	dialTimeout := flags.Duration("dial-timeout", envDuration("HTTP_DIAL_TIMEOUT", defaults.DialTimeout), "Timeout for opening a connection (env HTTP_DIAL_TIMEOUT)")
+	tlsTimeout := flags.Duration("tls-timeout", envDuration("HTTP_TLS_TIMEOUT", defaults.TLSHandshakeTimeout), "Timeout for the TLS handshake (env HTTP_TLS_TIMEOUT)")
+	headerTimeout := flags.Duration("response-timeout", envDuration("HTTP_RESPONSE_TIMEOUT", defaults.ResponseHeaderTimeout), "Timeout for the server to start responding (env HTTP_RESPONSE_TIMEOUT)")
+	timeout := flags.Duration("timeout", envDuration("HTTP_TIMEOUT", defaults.Timeout), "Timeout for a whole request, 0 for none (env HTTP_TIMEOUT)")
+	proxy := flags.String("proxy", os.Getenv("HTTP_PROXY_URL"), "HTTP(S) proxy URL; defaults to HTTPS_PROXY/HTTP_PROXY (env HTTP_PROXY_URL)")
+	caFile := flags.String("ca-file", os.Getenv("HTTP_CA_FILE"), "PEM file with extra CA certificates to trust (env HTTP_CA_FILE)")
+	record := flags.String("record", "", "Record all HTTP traffic (credentials redacted) to this cassette file")
+	replay := flags.String("replay", "", "Serve HTTP responses from this cassette file instead of the network")
+	harPath := flags.String("har", "", "Write all HTTP traffic of the run to this HAR file (credentials masked)")
+
+	return func() (func(), error) {
+		finish := func() {}
+		cnf := rest.ClientConfig{
+			DialTimeout:           *dialTimeout,
+			TLSHandshakeTimeout:   *tlsTimeout,
+			ResponseHeaderTimeout: *headerTimeout,
+			Timeout:               *timeout,
+			Proxy:                 *proxy,
+			CAFile:                *caFile,
+		}
+		switch {
+		case *record != "" && *replay != "":
+			return finish, fmt.Errorf("-record and -replay can't be used together")
+		case *record != "":
+			recorder, err := rest.NewRecorder(*record)
+			if err != nil {
+				return finish, err
+			}
+			cnf.Wrap = recorder.Wrap
+			finish = func() { recorder.Close() }
+		case *replay != "":
+			replayer, err := rest.LoadCassette(*replay)
+			if err != nil {
+				return finish, err
+			}
+			cnf.Wrap = replayer.Wrap
+		}
+		if err := rest.Configure(cnf); err != nil {
+			return finish, err
+		}
+		// Retries and the like are part of the run's output
+		rest.OnEvent(func(event rest.Event) { fmt.Println(event) })
+
+		if *harPath != "" {
+			har := rest.NewHARRecorder()
+			rest.Observe(har.Observe)
+			closeCassette := finish
+			finish = func() {
+				closeCassette()
+				if err := har.WriteFile(*harPath); err != nil {
+					fmt.Fprintf(os.Stderr, "WARNING: Failed to write HAR file %q: %v\n", *harPath, err)
+				} else {
+					fmt.Printf("HTTP traffic written to %q\n", *harPath)
+				}
+			}
+		}
+		return finish, nil
+	}
+}
+
+// Registers the metrics flags on flags. The returned function starts
+// collecting once the flags are parsed, and returns a function to call with
+// the outcome when the run ends.
+func metricsFlags(flags *flag.FlagSet) func() (func(ok bool), error) {
+	addr := flags.String("metrics-addr", os.Getenv("METRICS_ADDR"), "Serve Prometheus metrics on this address during the run, e.g. ':9100' (env METRICS_ADDR)")
+	file := flags.String("metrics-file", os.Getenv("METRICS_FILE"), "Write Prometheus metrics to this file at the end of the run, for node_exporter's textfile collector (env METRICS_FILE)")
+
+	return func() (func(ok bool), error) {
+		finish := func(ok bool) {}
+		if *addr == "" && *file == "" {
+			return finish, nil
+		}
+		rest.Observe(metrics.ObserveHTTP)
+		rest.OnEvent(metrics.ObserveEvent)
+		metrics.HTTPConcurrency.Set(float64(rest.SiteConcurrency.Limit()))
+		metrics.CircuitOpen.Set(0)
+
+		if *addr != "" {
+			listener, err := net.Listen("tcp", *addr)
+			if err != nil {
+				return finish, fmt.Errorf("failed to listen on %q: %w", *addr, err)
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			go http.Serve(listener, mux)
+			fmt.Printf("Serving metrics on http://%s/metrics\n", listener.Addr())
+		}
+
+		finish = func(ok bool) {
+			metrics.FinishRun(ok)
+			if *file == "" {
+				return
+			}
+			if err := metrics.WriteFile(*file); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Failed to write metrics to %q: %v\n", *file, err)
+			}
+		}
+		return finish, nil
+	}
+}
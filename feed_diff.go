@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/feedfile"
+	"github.com/RoundRobinHood/jouma-data-migration/tarsus"
+)
+
+func runDiff(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := flags.String("format", "text", "Output format: 'text', 'json' or 'csv'")
+	out := flags.String("out", "", "Write the diff to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: diff [flags] <old feed> <new feed>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// Checked before any work is done or -out is created
+	switch *format = strings.ToLower(*format); *format {
+	case "text", "json", "csv":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %q: expected 'text', 'json' or 'csv'\n", *format)
+		os.Exit(2)
+	}
+
+	oldFile, err := feedfile.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %q: %v\n", flags.Arg(0), err)
+		os.Exit(1)
+	}
+	defer oldFile.Close()
+	newFile, err := feedfile.Open(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %q: %v\n", flags.Arg(1), err)
+		os.Exit(1)
+	}
+	defer newFile.Close()
+
+	diff, err := tarsus.Diff(tarsus.Decode(oldFile), tarsus.Decode(newFile))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to compare feeds:", err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %q: %v\n", *out, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch *format {
+	case "text":
+		diff.WriteText(w)
+	case "json":
+		err = diff.WriteJSON(w)
+	case "csv":
+		err = diff.WriteCSV(w)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write diff:", err)
+		os.Exit(1)
+	}
+}
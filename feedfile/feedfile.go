@@ -0,0 +1,48 @@
+// Package feedfile reads supplier feed files from disk.
+package feedfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// Opens a feed file, decompressing it on the fly if it is gzipped.
+func Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, file: file}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// Counts the bytes read through it.
+type CountingReader struct {
+	Reader io.Reader
+	N      int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.N += int64(n)
+	return n, err
+}
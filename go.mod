@@ -4,15 +4,19 @@ go 1.24.4
 
 require (
 	github.com/cheggaaa/pb/v3 v3.1.7
+	github.com/gen2brain/webp v0.5.5
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/image v0.29.0
 )
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
+	github.com/ebitengine/purego v0.8.3 // indirect
 	github.com/fatih/color v1.18.0 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/tetratelabs/wazero v1.9.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 )
@@ -0,0 +1,149 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+type Options struct {
+	// Maximum output size in pixels. Zero means no limit.
+	MaxWidth  int
+	MaxHeight int
+	// Output format: "jpeg", "png", "webp" or "gif". Empty keeps the input
+	// format.
+	Format string
+	// JPEG and WebP quality (1-100). WebP at 100 is lossless.
+	Quality int
+	// Pad the image to a square on a white background.
+	Square bool
+}
+
+// Reports whether Normalize can encode format. Empty means the input format.
+func ValidFormat(format string) bool {
+	switch format {
+	case "", "jpeg", "png", "webp", "gif":
+		return true
+	}
+	return false
+}
+
+// Decodes an image, applies its EXIF orientation, resizes and pads it as
+// configured, and encodes it again. Metadata such as EXIF is not carried
+// over to the output.
+func Normalize(data []byte, opt Options) ([]byte, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrUnsupportedFormat, err)
+	}
+
+	if format == "jpeg" {
+		img = applyOrientation(img, exifOrientation(data))
+	}
+
+	img = fit(img, opt.MaxWidth, opt.MaxHeight)
+	if opt.Square {
+		img = padSquare(img)
+	}
+
+	outFormat := opt.Format
+	if outFormat == "" {
+		outFormat = format
+	}
+
+	quality := opt.Quality
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+	quality = min(quality, 100)
+
+	var buf bytes.Buffer
+	switch outFormat {
+	case "jpeg":
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "webp":
+		err = webp.Encode(&buf, img, webp.Options{Quality: quality, Lossless: quality == 100, Method: 4})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		return nil, "", fmt.Errorf("%w: can't encode %q", ErrUnsupportedFormat, outFormat)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode %s: %w", outFormat, err)
+	}
+
+	return buf.Bytes(), "image/" + outFormat, nil
+}
+
+// File extension (with dot) for a content type returned by Normalize.
+func Extension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	}
+	return ""
+}
+
+func fit(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale == 1.0 {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+func padSquare(img image.Image) image.Image {
+	bounds := img.Bounds()
+	side := max(bounds.Dx(), bounds.Dy())
+	if bounds.Dx() == bounds.Dy() {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	offset := image.Pt((side-bounds.Dx())/2, (side-bounds.Dy())/2)
+	draw.Draw(dst, image.Rectangle{Min: offset, Max: offset.Add(bounds.Size())}, img, bounds.Min, draw.Over)
+	return dst
+}
+
+// JPEG has no alpha channel, so transparent areas are put on white
+func flatten(img image.Image) image.Image {
+	if _, ok := img.(*image.YCbCr); ok {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
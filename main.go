@@ -1,105 +1,300 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
+	"iter"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
-	"github.com/RoundRobinHood/jouma-data-migration/rest"
+	"github.com/RoundRobinHood/jouma-data-migration/images"
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
+	"github.com/RoundRobinHood/jouma-data-migration/supplier"
 	"github.com/RoundRobinHood/jouma-data-migration/syncing"
+	"github.com/RoundRobinHood/jouma-data-migration/tarsus"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
 	_ "github.com/joho/godotenv/autoload"
 )
 
+var commands = map[string]func(ctx context.Context, args []string){
+	"cleanup-media": runCleanupMedia,
+	"diff":          runDiff,
+	"validate":      runValidate,
+}
+
 func main() {
-	source := flag.String("source", "file", "Source of the data: 'api' or 'file'")
-	filePath := flag.String("file", "data.json", "Path to JSON file if using file source")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// A second interrupt kills the process as usual
+		stop()
+		fmt.Fprintln(os.Stderr, "Stopping: finishing in-flight requests...")
+	}()
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(ctx, os.Args[2:])
+			return
+		}
+	}
+
+	source := flag.String("source", "file", "Source of the data: 'api' or 'file' for the Tarsus feed, or 'csv'")
+	filePath := flag.String("file", "data.json", "Path to the feed file (optionally gzipped) for the file and csv sources")
+	csvConfig := flag.String("csv-config", "", "JSON file mapping CSV columns to product fields, for the csv source")
 	tarsusURL := flag.String("api", "https://feedgen.tarsusonline.co.za/api/DataFeed/Customer-ProductCatalogue", "URL to GET for Tarsus Products")
+	snapshotDir := flag.String("snapshot-dir", "snapshots", "Directory for compressed snapshots of the Tarsus feed")
+	keepSnapshots := flag.Int("keep-snapshots", 10, "Number of feed snapshots to keep (0 keeps all)")
+	suppliersFile := flag.String("suppliers", "", "JSON file listing further supplier feeds to merge with the main one")
+	mergeRules := flag.String("merge-rules", "in_stock,cheapest,preferred,eta", "Comma-separated rules choosing between suppliers offering the same item: in_stock, cheapest, preferred, eta")
+	preferredSuppliers := flag.String("preferred-suppliers", "", "Comma-separated supplier names for the preferred merge rule, most preferred first")
+	sumStock := flag.Bool("sum-stock", false, "Publish the combined stock of all suppliers offering an item")
+	filterFile := flag.String("filter", "", "JSON file of include/exclude rules for feed products. Products left out are removed from the shop (see -delete-policy).")
+	deletePolicy := flag.String("delete-policy", "delete", "What happens to shop products that left the feed or were filtered out: 'delete', 'draft' or 'leave'")
+	validationReport := flag.String("validation-report", "", "Write a JSON report of invalid feed products to this file")
+	force := flag.Bool("force", false, "Sync even if the Tarsus feed hasn't changed since the last successful sync")
+	imageHashes := flag.Bool("image-hash", false, "Track image content hashes to detect images changing behind the same URL")
+	deleteReplaced := flag.Bool("delete-replaced-images", false, "Delete replaced product images from the media library if no other product uses them")
+	mediaAlt := flag.String("media-alt", "", "Template for image alt text, e.g. '{{.Manufacturer}} {{.ShortDesc}}'")
+	mediaTitle := flag.String("media-title", "", "Template for image titles, e.g. '{{.Manufacturer}} {{.PartNr}}'")
+	mediaCaption := flag.String("media-caption", "", "Template for image captions")
+	normalize := flag.Bool("normalize-images", false, "Resize and re-encode new images locally and upload them, instead of letting WooCommerce sideload them")
+	imageMaxWidth := flag.Int("image-max-width", 1200, "Maximum width of normalized images (0 for no limit)")
+	imageMaxHeight := flag.Int("image-max-height", 1200, "Maximum height of normalized images (0 for no limit)")
+	imageFormat := flag.String("image-format", "jpeg", "Format of normalized images: 'jpeg', 'png', 'webp', 'gif' or '' to keep the original")
+	imageQuality := flag.Int("image-quality", 85, "JPEG and WebP quality of normalized images (WebP is lossless at 100)")
+	imageSquare := flag.Bool("image-square", false, "Pad normalized images to a square on a white background")
+	imageReport := flag.String("image-report", "", "Check every feed image and write a JSON report of missing or broken ones to this file")
+	minImageSize := flag.Int64("min-image-size", 0, "Images smaller than this many bytes are treated as broken, e.g. 1024 (0 to disable)")
+	placeholder := flag.Int("placeholder-image", 0, "Media ID to attach to products without a usable image")
+	placeholders := flag.String("placeholder-images", "", "JSON file mapping manufacturer names to placeholder media IDs")
+	overrides := flag.String("overrides", "", "JSON file pinning the name, description, price, categories or images of products by SKU")
+	applyTrafficLimits := trafficFlags(flag.CommandLine)
+	configureClients := clientFlags(flag.CommandLine)
+	startMetrics := metricsFlags(flag.CommandLine)
 	flag.Parse()
 
-	key := ""
-	secret := ""
-	wc_url := ""
-	tarsus_key := ""
-	app_user := ""
-	app_pass := ""
-
-	if key = os.Getenv("WC_CONSUMER_KEY"); key == "" {
-		fmt.Fprintln(os.Stderr, "Please provide WC consumer key")
+	applyTrafficLimits()
+	finishClients, err := configureClients()
+	defer finishClients()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid HTTP client settings:", err)
 		return
 	}
-	if secret = os.Getenv("WC_CONSUMER_SECRET"); secret == "" {
-		fmt.Fprintln(os.Stderr, "Please provide WC consumer secret")
+	finishMetrics, err := startMetrics()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid metrics settings:", err)
 		return
 	}
-	if wc_url = os.Getenv("APP_URL"); wc_url == "" {
-		fmt.Fprintln(os.Stderr, "Please provide WP site url")
+	synced := false
+	defer func() { finishMetrics(synced) }()
+
+	if syncing.Removal, err = syncing.ParseRemovalPolicy(*deletePolicy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	if tarsus_key = os.Getenv("TARSUS_KEY"); tarsus_key == "" {
-		fmt.Fprintln(os.Stderr, "Please provide Tarsus API key")
+	wc.TrackImageHashes = *imageHashes
+	syncing.DeleteReplacedImages = *deleteReplaced
+	syncing.ImageReportPath = *imageReport
+	wc.MinImageSize = *minImageSize
+	wc.PlaceholderImage = *placeholder
+	if *placeholders != "" {
+		if err := loadPlaceholders(*placeholders); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load placeholder images from %q: %v\n", *placeholders, err)
+			return
+		}
+	}
+	if *overrides != "" {
+		if err := loadOverrides(*overrides); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load overrides from %q: %v\n", *overrides, err)
+			return
+		}
+	}
+	var filter *supplier.ProductFilter
+	if *filterFile != "" {
+		if filter, err = supplier.LoadFilter(*filterFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load product filter from %q: %v\n", *filterFile, err)
+			return
+		}
+	}
+	if *normalize {
+		if !images.ValidFormat(strings.ToLower(*imageFormat)) {
+			fmt.Fprintf(os.Stderr, "Unknown image format %q: expected 'jpeg', 'png', 'webp', 'gif' or ''\n", *imageFormat)
+			return
+		}
+		wc.ImageNormalization = &images.Options{
+			MaxWidth:  *imageMaxWidth,
+			MaxHeight: *imageMaxHeight,
+			Format:    strings.ToLower(*imageFormat),
+			Quality:   *imageQuality,
+			Square:    *imageSquare,
+		}
+	}
+
+	if syncing.MediaText, err = parseMediaTemplates(*mediaAlt, *mediaTitle, *mediaCaption); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid media template:", err)
 		return
 	}
-	if app_user = os.Getenv("APP_USER"); app_user == "" {
-		fmt.Fprintln(os.Stderr, "Please provide application username")
+
+	wp_config, wc_config, ok := siteConfigs()
+	if !ok {
 		return
 	}
-	if app_pass = os.Getenv("APP_PWD"); app_pass == "" {
-		fmt.Fprintln(os.Stderr, "Please provide application password")
+	if err := wc.ResolveOverrideCategories(ctx, wc_config); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to resolve pinned categories:", err)
 		return
 	}
 
-	var bytes []byte
-	fmt.Println("Getting tarsus products...")
+	// Read back from disk so the feed is decoded as a stream
+	feedPath := *filePath
+	var feed tarsus.Feed
+	tarsus_client := &tarsus.Client{
+		URL:           *tarsusURL,
+		SnapshotDir:   *snapshotDir,
+		KeepSnapshots: *keepSnapshots,
+	}
 	if strings.ToLower(*source) == "api" {
-		resp, err := rest.Request(*tarsusURL, &rest.RequestOptions{
-			Method:           "GET",
-			Headers:          map[string]string{"Authorization": "Bearer " + tarsus_key},
-			WithNetworkRetry: true,
-		}, nil, nil)
+		tarsus_key, ok := requireEnv("TARSUS_KEY", "Tarsus API key")
+		if !ok {
+			return
+		}
+		tarsus_client.Token = tarsus_key
+		fmt.Println("Getting tarsus products...")
+		feed, err = tarsus_client.Fetch(ctx)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Failed to GET tarsusUrl:", err)
 			return
 		}
-		bytes = resp.Body
-		err = os.WriteFile(*filePath, bytes, 0644)
+		err = tarsus.Extract(feed.Snapshot, *filePath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "WARNING: Failed to back up tarsus data to %s before processing. Err: \n%s\n", *filePath, err)
+			feedPath = feed.Snapshot
 		}
-		fmt.Printf("Products aqcuired from %q\n", *tarsusURL)
-	} else {
-		var err error
-		bytes, err = os.ReadFile(*filePath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to read tarsus products from %q. Err: \n%s\n", *filePath, err)
+		if feed.NotModified {
+			fmt.Printf("Tarsus feed not modified, using snapshot %q\n", feed.Snapshot)
+		} else {
+			fmt.Printf("Products aqcuired from %q\n", *tarsusURL)
+		}
+		// The other suppliers' feeds may have changed even if this one hasn't
+		if feed.Unchanged && *suppliersFile == "" && !*force {
+			fmt.Println("Tarsus feed unchanged since the last successful sync. Nothing to do (pass -force to sync anyway).")
+			synced = true
 			return
 		}
-		fmt.Printf("Products acquired from %q\n", *filePath)
 	}
 
-	var products struct {
-		Products []types.TarsusProduct `json:"products"`
-	}
-	if err := json.Unmarshal(bytes, &products); err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to unmarshal Tarsus products:", err)
+	src, err := feedSource(*source, feedPath, *csvConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid source:", err)
 		return
 	}
+	if strings.ToLower(*source) != "api" {
+		fmt.Printf("Reading %s products from %q\n", src.Name(), feedPath)
+	}
+	sources := []supplier.Source{src}
+	if *suppliersFile != "" {
+		extra, err := loadSuppliers(*suppliersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load suppliers from %q: %v\n", *suppliersFile, err)
+			return
+		}
+		sources = append(sources, extra...)
+	}
 
-	wc_auth := base64.StdEncoding.EncodeToString([]byte(key + ":" + secret))
-	wc_config := types.ApiConfig{
-		BaseUrl: wc_url,
-		APIKey:  wc_auth,
+	// Each feed is validated on its own, so SKUs only have to be unique per
+	// supplier
+	validators := make([]*supplier.Validator, len(sources))
+	feeds := make([]iter.Seq2[types.Product, error], len(sources))
+	for i, src := range sources {
+		validators[i] = supplier.NewValidator()
+		feeds[i] = validators[i].Filter(src.Products())
+	}
+	feedProducts := feeds[0]
+	var merger *supplier.Merger
+	if len(sources) > 1 {
+		rules, err := supplier.ParseMergeRules(*mergeRules)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		var preferred []string
+		for _, name := range strings.Split(*preferredSuppliers, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				preferred = append(preferred, name)
+			}
+		}
+		merger = supplier.NewMerger(supplier.MergeOptions{Rules: rules, Preferred: preferred, SumStock: *sumStock})
+		feedProducts = merger.Merge(feeds)
+		wc.TrackSuppliers = true
+	}
+	if filter != nil {
+		feedProducts = filter.Apply(feedProducts)
 	}
 
-	wp_auth := base64.StdEncoding.EncodeToString([]byte(app_user + ":" + app_pass))
-	wp_config := types.ApiConfig{
-		BaseUrl: wc_url,
-		APIKey:  wp_auth,
+	// The sync reads the feeds more than once. Only the first complete read is
+	// reported.
+	reported := false
+	skipped := map[string]struct{}{}
+	products := func(yield func(types.Product, error) bool) {
+		for product, err := range feedProducts {
+			if !yield(product, err) {
+				return
+			}
+		}
+		if reported {
+			return
+		}
+		reported = true
+		reports := make([]supplier.ValidationReport, len(sources))
+		var bytesRead int64
+		for i, src := range sources {
+			reports[i] = validators[i].Report()
+			bytesRead += src.BytesRead()
+		}
+		report := supplier.CombineReports(reports...)
+		for _, sku := range report.Skipped {
+			skipped[sku] = struct{}{}
+		}
+		metrics.FeedBytes.Set(float64(bytesRead))
+		metrics.FeedProducts.Set(float64(report.Products))
+		supplier.PrintValidationSummary(report)
+		if merger != nil {
+			supplier.PrintMergeSummary(merger.Report())
+		}
+		if filter != nil {
+			filtered := filter.Report()
+			metrics.FeedFiltered.Reset()
+			for rule, count := range filtered.Removed {
+				metrics.FeedFiltered.Set(float64(count), rule)
+			}
+			supplier.PrintFilterSummary(filtered)
+		}
+		if *validationReport != "" {
+			if err := supplier.WriteValidationReport(*validationReport, report); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Failed to write validation report to %q: %v\n", *validationReport, err)
+			}
+		}
 	}
 
-	fmt.Printf("Syncing towards WooCommerce API at %q\n", wc_url)
-	syncing.SyncUp(wp_config, wc_config, products.Products)
+	fmt.Printf("Syncing towards WooCommerce API at %q\n", wc_config.BaseUrl)
+	isSkipped := func(sku string) bool {
+		_, ok := skipped[sku]
+		return ok
+	}
+	if err := syncing.SyncUp(ctx, wp_config, wc_config, products, isSkipped); err != nil {
+		fmt.Fprintln(os.Stderr, "Sync stopped early:", err)
+		// os.Exit skips deferred calls
+		finishMetrics(false)
+		finishClients()
+		os.Exit(1)
+	}
+	synced = true
+	if feed.Hash != "" {
+		if err := tarsus_client.MarkSynced(feed); err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: Failed to record the synced feed version:", err)
+		}
+	}
 }
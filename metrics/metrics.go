@@ -0,0 +1,228 @@
+// Package metrics keeps counters, gauges and histograms in memory and writes
+// them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registryLock sync.Mutex
+var registry []metric
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, m)
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// A counter or gauge, optionally split by labels.
+type Value struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newValue(kind, name, help string, labels []string) *Value {
+	v := &Value{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}, keys: map[string][]string{}}
+	register(v)
+	return v
+}
+
+func NewCounter(name, help string, labels ...string) *Value {
+	return newValue("counter", name, help, labels)
+}
+
+func NewGauge(name, help string, labels ...string) *Value {
+	return newValue("gauge", name, help, labels)
+}
+
+func (v *Value) Add(delta float64, labels ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	key := labelKey(labels)
+	v.keys[key] = labels
+	v.values[key] += delta
+}
+
+func (v *Value) Inc(labels ...string) {
+	v.Add(1, labels...)
+}
+
+func (v *Value) Set(value float64, labels ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	key := labelKey(labels)
+	v.keys[key] = labels
+	v.values[key] = value
+}
+
+// Drops every series, so that labels which aren't set again stop being
+// reported.
+func (v *Value) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values = map[string]float64{}
+	v.keys = map[string][]string{}
+}
+
+func (v *Value) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.keys[key]), formatFloat(v.values[key]))
+	}
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// buckets are upper bounds in increasing order
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := labelKey(labels)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+func Write(w io.Writer) {
+	registryLock.Lock()
+	metrics := append([]metric{}, registry...)
+	registryLock.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
+
+// Writes all metrics to path for node_exporter's textfile collector. The file
+// is replaced atomically, so the collector never sees a partial file.
+func WriteFile(path string) error {
+	var buf bytes.Buffer
+	Write(&buf)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/RoundRobinHood/jouma-data-migration/rest"
+)
+
+var (
+	HTTPRequests = NewCounter("wcsync_http_requests_total", "HTTP request attempts by host, endpoint, method and status.", "host", "endpoint", "method", "status")
+	HTTPDuration = NewHistogram("wcsync_http_request_duration_seconds", "Time until the response headers arrived.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}, "host", "endpoint", "method")
+	HTTPRetries     = NewCounter("wcsync_http_retries_total", "Request attempts after the first.", "host", "endpoint", "method")
+	HTTPRateLimited = NewCounter("wcsync_http_rate_limited_total", "Responses with status 429.", "host", "endpoint")
+	HTTPConcurrency = NewGauge("wcsync_http_concurrency_limit", "Current limit on requests in flight to the site.")
+	CircuitOpen     = NewGauge("wcsync_circuit_open", "1 while the site's circuit breaker is open.")
+	CircuitOpened   = NewCounter("wcsync_circuit_opened_total", "Times the site's circuit breaker opened.")
+
+	PhaseDuration = NewGauge("wcsync_sync_phase_duration_seconds", "Duration of each sync phase in the last run.", "phase")
+	Products      = NewCounter("wcsync_products_total", "Products created, updated, deleted, drafted, published, skipped or failed.", "action")
+	FeedProducts  = NewGauge("wcsync_feed_products", "Products in the supplier feeds.")
+	FeedBytes     = NewGauge("wcsync_feed_bytes", "Size of the supplier feeds.")
+	FeedFiltered  = NewGauge("wcsync_feed_products_filtered", "Feed products left out of the shop, by filter rule.", "rule")
+	LastRun       = NewGauge("wcsync_last_run_timestamp_seconds", "Time the last run finished.")
+	LastRunOK     = NewGauge("wcsync_last_run_success", "1 if the last run completed, 0 if it stopped early.")
+)
+
+var idSegment = regexp.MustCompile(`/\d+(/|$)`)
+
+// Groups URLs so label values stay bounded: WP REST routes with IDs replaced,
+// and everything else (image hosts, the feed) by host only.
+func endpoint(path string) string {
+	_, route, ok := strings.Cut(path, "/wp-json")
+	if !ok {
+		return "external"
+	}
+	for idSegment.MatchString(route) {
+		route = idSegment.ReplaceAllString(route, "/:id$1")
+	}
+	return route
+}
+
+// Records an attempt made through rest. Register with rest.Observe.
+func ObserveHTTP(exchange rest.Exchange) {
+	host := exchange.Request.URL.Host
+	route := endpoint(exchange.Request.URL.Path)
+	method := exchange.Request.Method
+
+	status := "error"
+	if exchange.Err == nil || exchange.Response.StatusCode != 0 {
+		status = fmt.Sprint(exchange.Response.StatusCode)
+		HTTPDuration.Observe(exchange.Response.Duration.Seconds(), host, route, method)
+	}
+	HTTPRequests.Inc(host, route, method, status)
+	if exchange.Attempt > 1 {
+		HTTPRetries.Inc(host, route, method)
+	}
+	if exchange.Response.StatusCode == 429 {
+		HTTPRateLimited.Inc(host, route)
+	}
+}
+
+// Records changes rest makes to how it treats the site. Register with
+// rest.OnEvent.
+func ObserveEvent(event rest.Event) {
+	switch event.Kind {
+	case rest.EventConcurrency:
+		HTTPConcurrency.Set(float64(event.Limit))
+	case rest.EventBreakerOpen:
+		CircuitOpen.Set(1)
+		CircuitOpened.Inc()
+	case rest.EventBreakerClosed:
+		CircuitOpen.Set(0)
+	}
+}
+
+// Starts timing a phase. Call the returned function when it ends.
+func Phase(name string) func() {
+	start := time.Now()
+	return func() {
+		PhaseDuration.Set(time.Since(start).Seconds(), name)
+	}
+}
+
+func FinishRun(ok bool) {
+	LastRun.Set(float64(time.Now().Unix()))
+	if ok {
+		LastRunOK.Set(1)
+	} else {
+		LastRunOK.Set(0)
+	}
+}
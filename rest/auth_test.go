@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Signature base string built straight from RFC 5849, section 3.4.1
+func oauthBase(method, rawURL string, query url.Values) string {
+	params := make([]string, 0)
+	for key, values := range query {
+		if key == "oauth_signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, oauthEscape(key)+"="+oauthEscape(value))
+		}
+	}
+	sort.Strings(params)
+	return method + "&" + url.QueryEscape(rawURL) + "&" + oauthEscape(strings.Join(params, "&"))
+}
+
+func TestOAuth1(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		baseURL string
+		// Query parameters that must survive signing
+		keep map[string]string
+	}{
+		{"plain GET", "GET", "http://shop.test/wp-json/wc/v3/products", "http://shop.test/wp-json/wc/v3/products", nil},
+		{"query parameters", "GET", "http://shop.test/wp-json/wc/v3/products?per_page=100&page=2", "http://shop.test/wp-json/wc/v3/products", map[string]string{"per_page": "100", "page": "2"}},
+		{"space and reserved characters", "GET", "http://shop.test/products?search=a%20b%2Bc~d", "http://shop.test/products", map[string]string{"search": "a b+c~d"}},
+		{"lower-case method", "post", "http://shop.test/wp-json/wc/v3/products/batch", "http://shop.test/wp-json/wc/v3/products/batch", nil},
+		{"stale OAuth parameters are replaced", "GET", "http://shop.test/products?oauth_nonce=old&oauth_signature=old&sku=A1", "http://shop.test/products", map[string]string{"sku": "A1"}},
+		{"fragment is not signed", "GET", "http://shop.test/products?sku=A1#top", "http://shop.test/products", map[string]string{"sku": "A1"}},
+	}
+
+	auth := OAuth1{ConsumerKey: "ck_test", ConsumerSecret: "cs_secret"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := auth.Authenticate(req); err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+
+			query := req.URL.Query()
+			for key, want := range map[string]string{"oauth_consumer_key": "ck_test", "oauth_signature_method": "HMAC-SHA256"} {
+				if got := query.Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+			for _, key := range []string{"oauth_nonce", "oauth_timestamp", "oauth_signature"} {
+				if len(query[key]) != 1 || query.Get(key) == "" || query.Get(key) == "old" {
+					t.Errorf("%s = %q, want one fresh value", key, query[key])
+				}
+			}
+			for key, want := range test.keep {
+				if got := query.Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+
+			mac := hmac.New(sha256.New, []byte("cs_secret&"))
+			mac.Write([]byte(oauthBase(strings.ToUpper(test.method), test.baseURL, query)))
+			if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); query.Get("oauth_signature") != want {
+				t.Errorf("oauth_signature = %q, want %q", query.Get("oauth_signature"), want)
+			}
+		})
+	}
+}
+
+func TestOAuthEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"abc-._~", "abc-._~"},
+		{"a b", "a%20b"},
+		{"a+b", "a%2Bb"},
+		{"*", "%2A"},
+		{"/?&=", "%2F%3F%26%3D"},
+		{"é", "%C3%A9"},
+	}
+	for _, test := range tests {
+		if got := oauthEscape(test.in); got != test.want {
+			t.Errorf("oauthEscape(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("store unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Stops requests to a host after Threshold consecutive failures. While open,
+// requests fail fast with ErrCircuitOpen. After OpenFor, a single probe
+// request is let through: success closes the breaker, failure opens it again.
+type CircuitBreaker struct {
+	Threshold int
+	OpenFor   time.Duration
+
+	lock     sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	opened   chan struct{}
+}
+
+func NewCircuitBreaker(threshold int, openFor time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, OpenFor: openFor, opened: make(chan struct{})}
+}
+
+// Network errors and 5xx responses count as failures, since they mean the
+// host is down or broken rather than rejecting the request.
+func breakerFailure(resp Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode >= 500
+}
+
+// Returns ErrCircuitOpen if a request may not be sent now. Every nil return
+// must be followed by a call to Record.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.OpenFor {
+			return fmt.Errorf("%w: %d consecutive failed requests, retrying in %s", ErrCircuitOpen, b.failures, (b.OpenFor - time.Since(b.openedAt)).Round(time.Second))
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w: waiting on a probe request", ErrCircuitOpen)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Record(resp Response, err error) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	event := b.record(resp, err)
+	b.lock.Unlock()
+	if event != nil {
+		notifyEvent(*event)
+	}
+}
+
+// Updates the state with an outcome. Returns the event to report if the
+// breaker opened or closed. Must be called with the lock held.
+func (b *CircuitBreaker) record(resp Response, err error) *Event {
+	wasProbe := b.state == breakerHalfOpen && b.probing
+	if wasProbe {
+		b.probing = false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// Says nothing about the host. An unfinished probe gets retried.
+		return nil
+	}
+	if !breakerFailure(resp, err) {
+		var event *Event
+		if b.state != breakerClosed {
+			event = &Event{Kind: EventBreakerClosed}
+			b.opened = make(chan struct{})
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return event
+	}
+
+	b.failures++
+	switch {
+	case wasProbe:
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	case b.state == breakerClosed && b.Threshold > 0 && b.failures >= b.Threshold:
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		close(b.opened)
+		return &Event{Kind: EventBreakerOpen, Failures: b.failures, Delay: b.OpenFor}
+	}
+	return nil
+}
+
+// Gives back a request let through by Allow without counting its outcome
+// either way. An unfinished probe gets retried.
+func (b *CircuitBreaker) Discard() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// Closed when the breaker opens. The channel is replaced once it closes again.
+func (b *CircuitBreaker) Opened() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.opened
+}
+
+// Shared by the WooCommerce and WordPress clients, since both hit the same
+// host.
+var SiteBreaker = NewCircuitBreaker(10, 30*time.Second)
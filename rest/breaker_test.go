@@ -0,0 +1,155 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type breakerStep struct {
+	// Lets OpenFor pass before this step
+	wait bool
+	// Expect Allow to refuse
+	refused bool
+	status  int
+	err     error
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	down := errors.New("connection refused")
+	fail := breakerStep{status: 503}
+	ok := breakerStep{status: 200}
+	refused := breakerStep{refused: true}
+	tests := []struct {
+		name     string
+		steps    []breakerStep
+		wantOpen bool
+	}{
+		{"below the threshold", []breakerStep{fail, fail}, false},
+		{"opens at the threshold", []breakerStep{fail, fail, fail, refused}, true},
+		{"network errors count", []breakerStep{{err: down}, {err: down}, {err: down}, refused}, true},
+		{"success resets the count", []breakerStep{fail, fail, ok, fail, fail}, false},
+		{"client errors don't count", []breakerStep{{status: 404}, {status: 400}, {status: 429}, ok}, false},
+		{"cancellation doesn't count", []breakerStep{fail, fail, {err: context.Canceled}, ok}, false},
+		{"successful probe closes", []breakerStep{fail, fail, fail, refused, {wait: true, status: 200}, ok}, false},
+		{"failed probe opens again", []breakerStep{fail, fail, fail, {wait: true, status: 502}, refused}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := NewCircuitBreaker(3, time.Minute)
+			for i, step := range test.steps {
+				if step.wait {
+					breaker.openedAt = breaker.openedAt.Add(-breaker.OpenFor)
+				}
+				err := breaker.Allow()
+				if step.refused {
+					if !errors.Is(err, ErrCircuitOpen) {
+						t.Fatalf("step %d: Allow() = %v, want ErrCircuitOpen", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: Allow() = %v", i, err)
+				}
+				breaker.Record(Response{StatusCode: step.status}, step.err)
+			}
+
+			select {
+			case <-breaker.Opened():
+				if !test.wantOpen {
+					t.Error("breaker is open")
+				}
+			default:
+				if test.wantOpen {
+					t.Error("breaker is closed")
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.Record(Response{StatusCode: 500}, nil)
+	breaker.openedAt = breaker.openedAt.Add(-time.Minute)
+
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second request during the probe: Allow() = %v, want ErrCircuitOpen", err)
+	}
+	// An interrupted probe is retried
+	breaker.Record(Response{}, context.Canceled)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe after cancellation refused: %v", err)
+	}
+	// So is one whose outcome was discarded
+	breaker.Discard()
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe after a discarded one refused: %v", err)
+	}
+}
+
+func TestExpectedStatusesSkipBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(504)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		expected map[int]bool
+		wantOpen bool
+	}{
+		{"unexpected 504s count", nil, true},
+		{"expected 504s don't", map[int]bool{504: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &RestClient{Client: server.Client(), Breaker: NewCircuitBreaker(2, time.Minute)}
+			for range 3 {
+				client.Request(context.Background(), server.URL, &RequestOptions{ExpectedStatuses: test.expected}, nil)
+			}
+			select {
+			case <-client.Breaker.Opened():
+				if !test.wantOpen {
+					t.Error("breaker is open")
+				}
+			default:
+				if test.wantOpen {
+					t.Error("breaker is closed")
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerEvents(t *testing.T) {
+	var kinds []EventKind
+	OnEvent(func(event Event) {
+		if event.Kind == EventBreakerOpen || event.Kind == EventBreakerClosed {
+			kinds = append(kinds, event.Kind)
+		}
+	})
+	breaker := NewCircuitBreaker(2, time.Minute)
+	for _, status := range []int{500, 500, 200, 500, 500} {
+		if breaker.Allow() != nil {
+			breaker.openedAt = breaker.openedAt.Add(-time.Minute)
+			breaker.Allow()
+		}
+		breaker.Record(Response{StatusCode: status}, nil)
+	}
+	want := []EventKind{EventBreakerOpen, EventBreakerClosed, EventBreakerOpen}
+	if len(kinds) != len(want) {
+		t.Fatalf("events %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("events %v, want %v", kinds, want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// One request and its response, as stored in a cassette file. Cassettes are
+// JSON lines, one interaction per line, so a run that dies part-way still
+// leaves a usable file.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	// Set instead of the fields above when no response was received
+	Error string `json:"error,omitempty"`
+	// The body was too big to record, or wasn't read to the end
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-WP-Nonce"}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range secretHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, "REDACTED")
+		}
+	}
+	return header
+}
+
+// Binary bodies (images) are stored as base64.
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// Reads the request body without consuming it.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, err
+}
+
+// Appends every request and response sent through its transports to a
+// cassette file, with credentials redacted.
+type Recorder struct {
+	// Response bodies longer than this are left out of the cassette, so big
+	// downloads like the supplier feed aren't held in memory
+	MaxBody int64
+
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cassette: %w", err)
+	}
+	return &Recorder{MaxBody: 16 << 20, file: file}, nil
+}
+
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+func (r *Recorder) record(interaction Interaction) error {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// Wraps next so that its traffic is recorded. Suitable for ClientConfig.Wrap.
+func (r *Recorder) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &recordingTransport{next: next, recorder: r}
+}
+
+type recordingTransport struct {
+	next     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := Interaction{Request: RecordedRequest{
+		Method: req.Method,
+		URL:    RedactURL(req.URL.String()),
+		Header: redactHeader(req.Header),
+	}}
+	interaction.Request.Body, interaction.Request.BodyEncoding = encodeBody(reqBody)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		interaction.Response.Error = err.Error()
+		if recordErr := t.recorder.record(interaction); recordErr != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: Failed to record request:", recordErr)
+		}
+		return nil, err
+	}
+
+	interaction.Response.StatusCode = resp.StatusCode
+	interaction.Response.Header = redactHeader(resp.Header)
+	// Recorded once the caller is done with the body
+	resp.Body = &recordingBody{ReadCloser: resp.Body, recorder: t.recorder, interaction: interaction}
+	return resp, nil
+}
+
+// Copies a response body as it is read, up to the recorder's MaxBody, and
+// records the interaction when it is closed.
+type recordingBody struct {
+	io.ReadCloser
+	recorder    *Recorder
+	interaction Interaction
+	body        bytes.Buffer
+	eof         bool
+	tooBig      bool
+	closed      bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.tooBig {
+		if int64(b.body.Len()+n) > b.recorder.MaxBody {
+			b.tooBig = true
+			b.body = bytes.Buffer{}
+		} else {
+			b.body.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.closed {
+		return err
+	}
+	b.closed = true
+	if b.tooBig || !b.eof {
+		b.interaction.Response.Truncated = true
+	} else {
+		b.interaction.Response.Body, b.interaction.Response.BodyEncoding = encodeBody(b.body.Bytes())
+	}
+	if recordErr := b.recorder.record(b.interaction); recordErr != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Failed to record request:", recordErr)
+	}
+	return err
+}
+
+// Serves responses from a cassette instead of the network. Requests are
+// matched on method, URL (ignoring the order of query parameters and cache
+// busters) and body. Repeated requests get the recorded responses in order.
+type Replayer struct {
+	lock      sync.Mutex
+	responses map[string][]RecordedResponse
+}
+
+func LoadCassette(path string) (*Replayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cassette: %w", err)
+	}
+	defer file.Close()
+
+	replayer := &Replayer{responses: map[string][]RecordedResponse{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 256<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("invalid cassette line %d: %w", line, err)
+		}
+		body, err := decodeBody(interaction.Request.Body, interaction.Request.BodyEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette line %d: %w", line, err)
+		}
+		key := replayKey(interaction.Request.Method, interaction.Request.URL, body)
+		replayer.responses[key] = append(replayer.responses[key], interaction.Response)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	return replayer, nil
+}
+
+func replayKey(method, rawURL string, body []byte) string {
+	rawURL = RedactURL(rawURL)
+	if parsed, err := url.Parse(rawURL); err == nil {
+		query := parsed.Query()
+		// Cache buster on WC product listings, and per-attempt OAuth values
+		for _, key := range []string{"_", "oauth_nonce", "oauth_timestamp", "oauth_signature"} {
+			query.Del(key)
+		}
+		parsed.RawQuery = query.Encode()
+		rawURL = parsed.String()
+	}
+	return strings.ToUpper(method) + " " + rawURL + "\n" + string(body)
+}
+
+// Ignores next: nothing is sent. Suitable for ClientConfig.Wrap.
+func (r *Replayer) Wrap(next http.RoundTripper) http.RoundTripper {
+	return r
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	key := replayKey(req.Method, req.URL.String(), body)
+
+	r.lock.Lock()
+	queue := r.responses[key]
+	if len(queue) == 0 {
+		r.lock.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, RedactURL(req.URL.String()))
+	}
+	recorded := queue[0]
+	// The last response keeps being served once the recorded ones run out
+	if len(queue) > 1 {
+		r.responses[key] = queue[1:]
+	}
+	r.lock.Unlock()
+
+	if recorded.Error != "" {
+		return nil, fmt.Errorf("recorded error: %s", recorded.Error)
+	}
+	if recorded.Truncated {
+		return nil, fmt.Errorf("response to %s %s wasn't recorded in full", req.Method, RedactURL(req.URL.String()))
+	}
+	respBody, err := decodeBody(recorded.Body, recorded.BodyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
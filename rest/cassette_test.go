@@ -0,0 +1,125 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Records requests against a test server, then replays them without it.
+func TestCassetteRoundTrip(t *testing.T) {
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=s3cret")
+		switch r.URL.Path {
+		case "/image":
+			w.Write([]byte{0xff, 0xd8, 0xff, 0x00})
+		case "/big":
+			w.Write(bytes.Repeat([]byte("x"), 64))
+		default:
+			w.Write([]byte(r.Method + " " + r.URL.Query().Get("page") + " " + string(body) + " " + string(rune('0'+counter))))
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.MaxBody = 32
+	requests := []struct {
+		method string
+		url    string
+		body   string
+	}{
+		{"GET", "/products?page=1&consumer_key=ck_live&consumer_secret=cs_live", ""},
+		{"GET", "/products?page=1&consumer_key=ck_live&consumer_secret=cs_live", ""},
+		{"POST", "/products", `{"sku":"A1"}`},
+		{"GET", "/image", ""},
+		{"GET", "/big", ""},
+	}
+	send := func(client *http.Client, method, url, body string) (int, string, error) {
+		req, err := http.NewRequestWithContext(context.Background(), method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "app-password")
+		req.Header.Set("X-WP-Nonce", "nonce")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), err
+	}
+
+	recording := &http.Client{Transport: recorder.Wrap(http.DefaultTransport)}
+	want := make([]string, len(requests))
+	for i, request := range requests {
+		_, want[i], err = send(recording, request.method, server.URL+request.url, request.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cassette, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"ck_live", "cs_live", "app-password", "dXNlcjphcHAtcGFzc3dvcmQ", "nonce", "s3cret"} {
+		if bytes.Contains(cassette, []byte(secret)) {
+			t.Errorf("cassette contains %q", secret)
+		}
+	}
+
+	replayer, err := LoadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaying := &http.Client{Transport: replayer.Wrap(nil)}
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"first of repeated requests", "GET", "/products?consumer_secret=other&page=1&consumer_key=other", "", want[0], false},
+		{"second of repeated requests", "GET", "/products?page=1&consumer_key=ck_live&consumer_secret=cs_live", "", want[1], false},
+		{"last response is served again", "GET", "/products?page=1&consumer_key=ck_live&consumer_secret=cs_live", "", want[1], false},
+		{"matched on body", "POST", "/products", `{"sku":"A1"}`, want[2], false},
+		{"different body", "POST", "/products", `{"sku":"B1"}`, "", true},
+		{"binary body", "GET", "/image", "", want[3], false},
+		{"cache buster ignored", "GET", "/image?_=12345", "", want[3], false},
+		{"body too big to record", "GET", "/big", "", "", true},
+		{"never recorded", "GET", "/categories", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, got, err := send(replaying, test.method, server.URL+test.url, test.body)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("body = %q, want %q", got, test.want)
+			}
+		})
+	}
+	if want[0] == want[1] {
+		t.Error("repeated requests got the same response from the server")
+	}
+}
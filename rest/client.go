@@ -0,0 +1,121 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type ClientConfig struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// Limit on a whole request, including reading the body. Zero means none.
+	Timeout time.Duration
+	// Empty means the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+	// variables are used.
+	Proxy string
+	// PEM file of extra CAs to trust, on top of the system pool
+	CAFile string
+	// Wraps the transport of every client, e.g. Recorder.Wrap
+	Wrap func(http.RoundTripper) http.RoundTripper
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 90 * time.Second,
+		Timeout:               3 * time.Minute,
+	}
+}
+
+func (c ClientConfig) transport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %w", c.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return transport, nil
+}
+
+type managedClient struct {
+	client *http.Client
+	// Overrides ClientConfig.Timeout when non-zero
+	timeout time.Duration
+}
+
+var clientsLock sync.Mutex
+var clients []managedClient
+var clientConfig = DefaultClientConfig()
+
+// Returns a client that follows the shared ClientConfig, now and after later
+// calls to Configure. A non-zero timeout replaces the configured overall
+// timeout for this client.
+func NewClient(timeout time.Duration) *http.Client {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	managed := managedClient{client: &http.Client{}, timeout: timeout}
+	// The default config has no files or URLs to fail on
+	transport, _ := clientConfig.transport()
+	managed.apply(transport, clientConfig)
+	clients = append(clients, managed)
+	return managed.client
+}
+
+func (m managedClient) apply(transport *http.Transport, cnf ClientConfig) {
+	m.client.Transport = transport
+	if cnf.Wrap != nil {
+		m.client.Transport = cnf.Wrap(transport)
+	}
+	m.client.Timeout = cnf.Timeout
+	if m.timeout != 0 {
+		m.client.Timeout = m.timeout
+	}
+}
+
+// Applies cnf to every client made by NewClient. Call it before sending any
+// requests, since clients are changed in place.
+func Configure(cnf ClientConfig) error {
+	transport, err := cnf.transport()
+	if err != nil {
+		return err
+	}
+
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	clientConfig = cnf
+	for _, managed := range clients {
+		managed.apply(transport, cnf)
+	}
+	return nil
+}
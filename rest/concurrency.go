@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits the number of requests in flight, AIMD style: the limit grows by
+// about one for every limit's worth of healthy responses, and is cut by
+// DecreaseFactor when the server signals overload.
+type AdaptiveConcurrency struct {
+	Min int
+	Max int
+	// Responses slower than this don't grow the limit. Zero disables the check.
+	LatencyTarget  time.Duration
+	DecreaseFactor float64
+	// Overload signals within this long of a cut are treated as part of the
+	// same event, since requests in flight at the time will fail together.
+	Cooldown time.Duration
+	// Status codes that count as overload
+	OverloadStatuses map[int]bool
+
+	lock         sync.Mutex
+	limit        float64
+	inFlight     int
+	lastDecrease time.Time
+	changed      chan struct{}
+}
+
+func NewAdaptiveConcurrency(initial, minimum, maximum int) *AdaptiveConcurrency {
+	return &AdaptiveConcurrency{
+		Min:              minimum,
+		Max:              maximum,
+		LatencyTarget:    5 * time.Second,
+		DecreaseFactor:   0.5,
+		Cooldown:         2 * time.Second,
+		OverloadStatuses: map[int]bool{429: true, 503: true, 504: true},
+		limit:            float64(initial),
+		changed:          make(chan struct{}),
+	}
+}
+
+// Current limit on requests in flight
+func (a *AdaptiveConcurrency) Limit() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.current()
+}
+
+func (a *AdaptiveConcurrency) current() int {
+	return max(a.Min, 1, min(a.Max, int(a.limit)))
+}
+
+// Wakes up everyone waiting in Acquire. Must be called with the lock held.
+func (a *AdaptiveConcurrency) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *AdaptiveConcurrency) Acquire(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	for {
+		a.lock.Lock()
+		if a.inFlight < a.current() {
+			a.inFlight++
+			a.lock.Unlock()
+			return nil
+		}
+		changed := a.changed
+		a.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Gives back a slot taken by Acquire, adjusting the limit from the outcome.
+func (a *AdaptiveConcurrency) Release(resp Response, err error) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	a.inFlight--
+
+	before := a.current()
+	reason := ""
+	switch {
+	case err == nil && a.OverloadStatuses[resp.StatusCode]:
+		if time.Since(a.lastDecrease) >= a.Cooldown {
+			a.limit = max(float64(a.Min), a.limit*a.DecreaseFactor)
+			a.lastDecrease = time.Now()
+			reason = fmt.Sprintf("status %d", resp.StatusCode)
+		}
+	case err == nil && resp.StatusCode < 500 && (a.LatencyTarget == 0 || resp.Duration <= a.LatencyTarget):
+		a.limit = min(float64(a.Max), a.limit+1/max(a.limit, 1))
+	}
+	after := a.current()
+	a.notify()
+	a.lock.Unlock()
+
+	if after != before {
+		notifyEvent(Event{Kind: EventConcurrency, Limit: after, Reason: reason})
+	}
+}
+
+// Shared by the WooCommerce and WordPress clients, since both hit the same
+// host.
+var SiteConcurrency = NewAdaptiveConcurrency(2, 1, 16)
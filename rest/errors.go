@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrAPI = errors.New("API returned an error")
+
+// A non-2xx response. WooCommerce and WordPress both answer errors with a
+// body like {"code": ..., "message": ..., "data": {"status": ...}}, which is
+// decoded into Code, Message and Data when present.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Code       string         `json:"code"`
+	Message    string         `json:"message"`
+	Data       map[string]any `json:"data"`
+	Body       []byte
+}
+
+func ErrorFromResponse(method, rawURL string, resp Response) *APIError {
+	apiErr := &APIError{
+		Method:     method,
+		URL:        RedactURL(rawURL),
+		StatusCode: resp.StatusCode,
+		Body:       resp.Body,
+	}
+	json.Unmarshal(resp.Body, apiErr)
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: status %d", e.Method, e.URL, e.StatusCode)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	} else if e.Code == "" && len(e.Body) != 0 {
+		body := string(e.Body)
+		if len(body) > 500 {
+			body = body[:500] + "..."
+		}
+		msg += "\nResponse body:\n" + body
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == ErrAPI
+}
+
+// The WC/WP error code of err, or "" if err is not an *APIError.
+func ErrorCode(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// The HTTP status of err, or 0 if err is not an *APIError.
+func ErrorStatus(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// The WC/WP error code in the response body, if any.
+func (r Response) ErrorCode() string {
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(r.Body, &body)
+	return body.Code
+}
+
+var secretParams = []string{"consumer_key", "consumer_secret", "oauth_signature", "oauth_consumer_key", "key", "token", "access_token", "password", "pwd"}
+
+// Replaces the values of query parameters that carry credentials, and any
+// user info.
+func RedactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	changed := false
+	if parsed.User != nil {
+		parsed.User = url.User("REDACTED")
+		changed = true
+	}
+	query := parsed.Query()
+	secrets := false
+	for key := range query {
+		for _, secret := range secretParams {
+			if strings.EqualFold(key, secret) {
+				query.Set(key, "REDACTED")
+				secrets = true
+			}
+		}
+	}
+	if !changed && !secrets {
+		return rawURL
+	}
+	if secrets {
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.String()
+}
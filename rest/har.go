@@ -0,0 +1,187 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/)
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Attempt         int         `json:"_attempt"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Collects every request attempt for a HAR file. Register Observe with
+// rest.Observe and call WriteFile at the end of the run.
+type HARRecorder struct {
+	lock    sync.Mutex
+	entries []harEntry
+}
+
+func NewHARRecorder() *HARRecorder {
+	return &HARRecorder{}
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	header = redactHeader(header)
+	pairs := make([]harNameValue, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+func (h *HARRecorder) Observe(exchange Exchange) {
+	req := exchange.Request
+	resp := exchange.Response
+	millis := float64(resp.Duration) / float64(time.Millisecond)
+
+	entry := harEntry{
+		StartedDateTime: exchange.Start.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            millis,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         RedactURL(req.URL.String()),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(exchange.RequestBody),
+		},
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(resp.Header),
+			Content: harContent{
+				Size:     len(resp.Body),
+				MimeType: resp.Header.Get("Content-Type"),
+			},
+			HeadersSize: -1,
+			BodySize:    len(resp.Body),
+		},
+		// Only the whole round trip is measured
+		Timings: harTimings{Wait: millis},
+		Attempt: exchange.Attempt,
+	}
+	if redacted, err := url.Parse(entry.Request.URL); err == nil {
+		for name, values := range redacted.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	if len(exchange.RequestBody) != 0 {
+		entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type")}
+		if utf8.Valid(exchange.RequestBody) {
+			entry.Request.PostData.Text = string(exchange.RequestBody)
+		}
+	}
+	// Images would make the file huge, so only text bodies are kept
+	if utf8.Valid(resp.Body) && !strings.HasPrefix(entry.Response.Content.MimeType, "image/") {
+		entry.Response.Content.Text = string(resp.Body)
+	} else if len(resp.Body) != 0 {
+		entry.Response.Content.Comment = "binary body omitted"
+	}
+	if exchange.Err != nil {
+		entry.Error = exchange.Err.Error()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = append(h.entries, entry)
+}
+
+func (h *HARRecorder) WriteFile(path string) error {
+	h.lock.Lock()
+	entries := make([]harEntry, len(h.entries))
+	copy(entries, h.entries)
+	h.lock.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedDateTime < entries[j].StartedDateTime })
+	data, err := json.MarshalIndent(map[string]harLog{"log": {
+		Version: "1.2",
+		Creator: harCreator{Name: "jouma-data-migration", Version: "1.0"},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
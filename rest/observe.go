@@ -0,0 +1,108 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A single attempt at a request, as passed to observers.
+type Exchange struct {
+	Start time.Time
+	// Starts at 1
+	Attempt     int
+	Request     *http.Request
+	RequestBody []byte
+	// Incomplete if Err is set
+	Response Response
+	Err      error
+}
+
+// Called after every attempt made by Request. Observers run on the
+// requesting goroutine, so they must be safe for concurrent use.
+type Observer func(Exchange)
+
+var observersLock sync.RWMutex
+var observers []Observer
+
+func Observe(observer Observer) {
+	observersLock.Lock()
+	defer observersLock.Unlock()
+	observers = append(observers, observer)
+}
+
+func notifyObservers(exchange Exchange) {
+	observersLock.RLock()
+	defer observersLock.RUnlock()
+	for _, observer := range observers {
+		observer(exchange)
+	}
+}
+
+type EventKind string
+
+const (
+	// A request is retried after Delay
+	EventRetry EventKind = "retry"
+	// The limit on requests in flight changed to Limit
+	EventConcurrency EventKind = "concurrency"
+	// The circuit breaker opened after Failures consecutive failures, for at
+	// least Delay
+	EventBreakerOpen EventKind = "breaker_open"
+	// The host is responding again
+	EventBreakerClosed EventKind = "breaker_closed"
+)
+
+// A decision rest made about a request or host, for logging and metrics.
+type Event struct {
+	Kind EventKind
+	// The request the event is about, with credentials redacted
+	Method string
+	URL    string
+	// Attempt that failed, starting at 1
+	Attempt int
+	Delay   time.Duration
+	// Status or error of the failed attempt, or the overload signal that cut
+	// the concurrency limit
+	Reason   string
+	Limit    int
+	Failures int
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case EventRetry:
+		return fmt.Sprintf("Retrying %s %s in %s (attempt %d): %s", e.Method, e.URL, e.Delay.Round(time.Millisecond), e.Attempt, e.Reason)
+	case EventConcurrency:
+		if e.Reason != "" {
+			return fmt.Sprintf("Got %s: reducing concurrency to %d", e.Reason, e.Limit)
+		}
+		return fmt.Sprintf("Raising concurrency to %d", e.Limit)
+	case EventBreakerOpen:
+		return fmt.Sprintf("Store unavailable after %d consecutive failed requests: opening circuit breaker for %s", e.Failures, e.Delay)
+	case EventBreakerClosed:
+		return "Store is responding again: closing circuit breaker"
+	}
+	return string(e.Kind)
+}
+
+// Called on every Event. Like observers, handlers run on the goroutine that
+// caused the event, so they must be safe for concurrent use.
+type EventHandler func(Event)
+
+var eventHandlers []EventHandler
+
+func OnEvent(handler EventHandler) {
+	observersLock.Lock()
+	defer observersLock.Unlock()
+	eventHandlers = append(eventHandlers, handler)
+}
+
+func notifyEvent(event Event) {
+	observersLock.RLock()
+	defer observersLock.RUnlock()
+	for _, handler := range eventHandlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EndpointClass int
+
+const (
+	ClassRead EndpointClass = iota
+	ClassWrite
+	ClassMedia
+)
+
+// Media requests are classed separately since they make WordPress do the
+// most work (sideloading, thumbnail generation).
+func Classify(method, rawURL string) EndpointClass {
+	if parsed, err := url.Parse(rawURL); err == nil && strings.Contains(parsed.Path, "/wp/v2/media") {
+		return ClassMedia
+	}
+	switch strings.ToUpper(method) {
+	case "", "GET", "HEAD", "OPTIONS":
+		return ClassRead
+	}
+	return ClassWrite
+}
+
+type Limit struct {
+	// Zero or less means unlimited
+	PerSecond float64
+	Burst     int
+}
+
+type TokenBucket struct {
+	lock   sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(limit Limit) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetLimit(limit)
+	return b
+}
+
+func (b *TokenBucket) SetLimit(limit Limit) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	b.limit = limit
+	b.tokens = float64(limit.Burst)
+	b.last = time.Now()
+}
+
+// Takes a token, waiting for one to become available if needed.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.lock.Lock()
+		if b.limit.PerSecond <= 0 {
+			b.lock.Unlock()
+			return nil
+		}
+		now := time.Now()
+		b.tokens = min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.PerSecond)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.lock.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.limit.PerSecond * float64(time.Second))
+		b.lock.Unlock()
+
+		if err := Sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// A request has to get a token from the overall bucket and from the bucket of
+// its endpoint class.
+type RateLimiter struct {
+	All     *TokenBucket
+	Classes map[EndpointClass]*TokenBucket
+}
+
+// Classes missing from classes are only bound by the overall limit.
+func NewRateLimiter(all Limit, classes map[EndpointClass]Limit) *RateLimiter {
+	l := &RateLimiter{All: NewTokenBucket(all), Classes: map[EndpointClass]*TokenBucket{}}
+	for _, class := range []EndpointClass{ClassRead, ClassWrite, ClassMedia} {
+		l.Classes[class] = NewTokenBucket(classes[class])
+	}
+	return l
+}
+
+// Changes the limits in place, so clients sharing l pick them up.
+func (l *RateLimiter) SetLimits(all Limit, classes map[EndpointClass]Limit) {
+	l.All.SetLimit(all)
+	for class, bucket := range l.Classes {
+		bucket.SetLimit(classes[class])
+	}
+}
+
+func (l *RateLimiter) Wait(ctx context.Context, method, rawURL string) error {
+	if l == nil {
+		return nil
+	}
+	if bucket, ok := l.Classes[Classify(method, rawURL)]; ok {
+		if err := bucket.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return l.All.Wait(ctx)
+}
+
+// Shared by the WooCommerce and WordPress clients, since both hit the same
+// host.
+var SiteLimiter = NewRateLimiter(Limit{PerSecond: 5, Burst: 5}, map[EndpointClass]Limit{
+	ClassWrite: {PerSecond: 2, Burst: 2},
+	ClassMedia: {PerSecond: 1, Burst: 1},
+})
@@ -2,20 +2,51 @@ package rest
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type RequestOptions struct {
-	Method           string
-	Headers          map[string]string
-	Body             any
-	WithNetworkRetry bool
-	RetryDelay       time.Duration
+	Method  string
+	Headers map[string]string
+	Body    any
+	// Applied to every attempt after Headers. Nil means the RestClient's.
+	Auth Authenticator
+	// Sent as-is instead of Body. Set Content-Type through Headers.
+	RawBody []byte
+	// Nil means a single attempt, unless the RestClient has a policy
+	Retry *RetryPolicy
+	// Allow retrying POST and PATCH requests after network errors and 5xx
+	// responses, for requests that are safe to repeat
+	RetryNonIdempotent bool
+	// Sent as the Idempotency-Key header on every attempt. POST and PATCH
+	// requests that may be retried get a fresh key if none is set. It doesn't
+	// allow retries by itself: WooCommerce and WordPress ignore the header, so
+	// only set RetryNonIdempotent as well where the target deduplicates on it.
+	IdempotencyKey string
+	// Error statuses the retry hook expects and handles, which don't count as
+	// failures for the circuit breaker
+	ExpectedStatuses map[int]bool
+	// Reads the body of a 2xx response instead of it being buffered into
+	// Response.Body, for downloads too big to hold in memory. It is called
+	// again if the request is retried, so it must start over each time.
+	Download func(body io.Reader) error
+
+	limiter     *RateLimiter
+	concurrency *AdaptiveConcurrency
+	breaker     *CircuitBreaker
+	// Let an attempt that is already in flight complete when the context is
+	// cancelled, so that writes are not cut off halfway. No new attempts are
+	// started after cancellation.
+	FinishInFlight bool
 }
 
 type Response struct {
@@ -28,99 +59,248 @@ type Response struct {
 var ErrRequestFailed = errors.New("HTTP(S)Req Failed")
 var ErrResponseFailed = errors.New("Failed to gather response")
 
-var reqClient = &http.Client{}
+var reqClient = NewClient(0)
 
 type RestClient struct {
 	Client *http.Client
+	// Used for requests that don't set their own policy
+	Retry *RetryPolicy
+	// Every attempt waits for a token. May be shared between clients.
+	Limiter *RateLimiter
+	// Every attempt waits for a slot. May be shared between clients.
+	Concurrency *AdaptiveConcurrency
+	// Fails requests fast while the host is down. May be shared between
+	// clients.
+	Breaker *CircuitBreaker
+	// Used for requests that don't set their own
+	Auth Authenticator
+}
+
+func (c *RestClient) Request(ctx context.Context, url string, opt *RequestOptions, ret any) (Response, error) {
+	options := RequestOptions{}
+	if opt != nil {
+		options = *opt
+	}
+	if options.Retry == nil {
+		options.Retry = c.Retry
+	}
+	if options.Auth == nil {
+		options.Auth = c.Auth
+	}
+	options.limiter = c.Limiter
+	options.concurrency = c.Concurrency
+	options.breaker = c.Breaker
+
+	return Request(ctx, url, &options, ret, c.Client)
+}
+
+// Waits for d, returning early with the context's error if it is cancelled.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
-func (c *RestClient) Request(url string, opt *RequestOptions, ret any) (Response, error) {
+func Request(ctx context.Context, url string, opt *RequestOptions, ret any, client *http.Client) (Response, error) {
 	if opt == nil {
 		opt = &RequestOptions{}
 	}
+	// Retry hooks may change the options between attempts
+	options := *opt
+	opt = &options
 
-	return Request(url, opt, ret, c.Client)
-}
+	useClient := reqClient
+	if client != nil {
+		useClient = client
+	}
 
-func Request(url string, opt *RequestOptions, ret any, client *http.Client) (Response, error) {
-	method := "GET"
-	headers := map[string]string{}
-	if opt != nil {
-		if opt.Method != "" {
-			method = opt.Method
+	var response Response
+	body, err := prepareBody(opt)
+	if err != nil {
+		return response, err
+	}
+
+	// Lets a server that deduplicates on the key recognise a retry
+	if opt.IdempotencyKey == "" && opt.Retry != nil && !opt.idempotent() {
+		opt.IdempotencyKey = NewIdempotencyKey()
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return response, fmt.Errorf("%w: %w", ErrRequestFailed, ctxErr)
+		}
+
+		if limitErr := opt.limiter.Wait(ctx, opt.method(), url); limitErr != nil {
+			return response, fmt.Errorf("%w: %w", ErrRequestFailed, limitErr)
+		}
+		if slotErr := opt.concurrency.Acquire(ctx); slotErr != nil {
+			return response, fmt.Errorf("%w: %w", ErrRequestFailed, slotErr)
+		}
+		if openErr := opt.breaker.Allow(); openErr != nil {
+			opt.concurrency.Release(Response{}, context.Canceled)
+			return response, fmt.Errorf("%w: %w", ErrRequestFailed, openErr)
+		}
+		response, err = send(ctx, url, opt, body, useClient, attempt)
+		if err == nil && opt.ExpectedStatuses[response.StatusCode] {
+			opt.breaker.Discard()
+		} else {
+			opt.breaker.Record(response, err)
+		}
+		opt.concurrency.Release(response, err)
+		if errors.Is(err, errBuildRequest) {
+			return response, err
+		}
+
+		policy := opt.Retry
+		if !opt.retryAllowed(response, err) {
+			policy = nil
+		}
+		retry, delay := policy.next(ctx, attempt, start, opt, response, err)
+		if !retry {
+			break
+		}
+		notifyEvent(Event{Kind: EventRetry, Method: opt.method(), URL: RedactURL(url), Attempt: attempt, Delay: delay, Reason: describeAttempt(response, err)})
+		// Hooks may have replaced the body
+		if policy.Hook != nil {
+			if body, err = prepareBody(opt); err != nil {
+				return response, err
+			}
 		}
-		if opt.Headers != nil {
-			headers = opt.Headers
+		if sleepErr := Sleep(ctx, delay); sleepErr != nil {
+			return response, fmt.Errorf("%w: %w", ErrRequestFailed, sleepErr)
 		}
 	}
-	var response Response
+	if err != nil {
+		return response, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response, ErrorFromResponse(opt.method(), url, response)
+	}
 
-	var body []byte
-	if opt.Body != nil {
-		bytes, err := json.Marshal(opt.Body)
-		if err != nil {
-			return response, fmt.Errorf("%w: failed to marshal request body: %w", ErrRequestFailed, err)
+	if ret != nil {
+		if err := json.Unmarshal(response.Body, ret); err != nil {
+			return response, fmt.Errorf("%w: failed to parse JSON: %w. Body: %s", ErrResponseFailed, err, string(response.Body))
 		}
-		body = bytes
 	}
 
-	var req *http.Request
+	return response, nil
+}
+
+var errBuildRequest = errors.New("failed to build request")
+
+func (opt *RequestOptions) method() string {
+	if opt.Method == "" {
+		return "GET"
+	}
+	return strings.ToUpper(opt.Method)
+}
+
+func (opt *RequestOptions) idempotent() bool {
+	switch opt.method() {
+	case "POST", "PATCH":
+		return false
+	}
+	return true
+}
+
+// POST and PATCH may have taken effect even if the response was lost, so they
+// are only retried when the caller opted in or the server rejected them
+// outright with a 429.
+func (opt *RequestOptions) retryAllowed(resp Response, err error) bool {
+	if opt.idempotent() {
+		return true
+	}
+	return opt.RetryNonIdempotent || (err == nil && resp.StatusCode == 429)
+}
+
+// Encodes the request body once, so every attempt can send the same bytes.
+func prepareBody(opt *RequestOptions) ([]byte, error) {
+	if opt.RawBody != nil {
+		return opt.RawBody, nil
+	}
+	if opt.Body == nil {
+		return nil, nil
+	}
+	body, err := json.Marshal(opt.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: failed to marshal request body: %w", ErrRequestFailed, errBuildRequest, err)
+	}
+	return body, nil
+}
+
+// Random key for RequestOptions.IdempotencyKey
+func NewIdempotencyKey() string {
+	var key [16]byte
+	rand.Read(key[:])
+	return hex.EncodeToString(key[:])
+}
+
+// Makes a single attempt at the request and reads the whole response, unless
+// it is handed to opt.Download.
+func send(ctx context.Context, url string, opt *RequestOptions, body []byte, client *http.Client, attempt int) (Response, error) {
+	var response Response
+
+	reqCtx := ctx
+	if opt.FinishInFlight {
+		reqCtx = context.WithoutCancel(ctx)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(reqCtx, opt.method(), url, reader)
+	if err != nil {
+		return response, fmt.Errorf("%w: %w: failed to create request: %w", ErrRequestFailed, errBuildRequest, err)
+	}
 	if body != nil {
-		obj, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-		if err != nil {
-			return response, fmt.Errorf("%w: failed to create request (with body): %w", ErrRequestFailed, err)
+		// Lets the transport replay the body on redirects and connection resets
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
 		}
-		obj.Header.Set("Content-Type", "application/json")
-		req = obj
-	} else {
-		obj, err := http.NewRequest(method, url, nil)
-		if err != nil {
-			return response, fmt.Errorf("%w: failed to create request (without body): %w", ErrRequestFailed, err)
+		if opt.RawBody == nil {
+			req.Header.Set("Content-Type", "application/json")
 		}
-		req = obj
 	}
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	if opt.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", opt.IdempotencyKey)
 	}
-
-	useClient := reqClient
-	if client != nil {
-		useClient = client
+	for key, value := range opt.Headers {
+		req.Header.Set(key, value)
 	}
-
-	var resp *http.Response
-	for {
-		var err error
-		now := time.Now()
-		resp, err = useClient.Do(req)
-		response.Duration = time.Since(now)
-		if err != nil {
-			if opt == nil || !opt.WithNetworkRetry {
-				return response, fmt.Errorf("%w: failed to send request: %w", ErrRequestFailed, err)
-			}
-			time.Sleep(opt.RetryDelay)
-			continue
+	if opt.Auth != nil {
+		if err := opt.Auth.Authenticate(req); err != nil {
+			return response, fmt.Errorf("%w: %w: failed to authenticate request: %w", ErrRequestFailed, errBuildRequest, err)
 		}
-		break
 	}
 
+	now := time.Now()
+	resp, err := client.Do(req)
+	response.Duration = time.Since(now)
+	if err != nil {
+		err = fmt.Errorf("%w: failed to send request: %w", ErrRequestFailed, err)
+		notifyObservers(Exchange{Start: now, Attempt: attempt, Request: req, RequestBody: body, Response: response, Err: err})
+		return response, err
+	}
 	defer resp.Body.Close()
 
 	response.StatusCode = resp.StatusCode
 	response.Header = resp.Header.Clone()
 
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return response, fmt.Errorf("%w: failed to read request: %w", ErrResponseFailed, err)
+	if opt.Download != nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		err = opt.Download(resp.Body)
+	} else {
+		response.Body, err = io.ReadAll(resp.Body)
 	}
-
-	response.Body = bytes
-
-	if ret != nil {
-		if err := json.Unmarshal(bytes, ret); err != nil {
-			return response, fmt.Errorf("%w: failed to parse JSON: %w. Body: %s", ErrResponseFailed, err, string(bytes))
-		}
+	if err != nil {
+		err = fmt.Errorf("%w: failed to read request: %w", ErrResponseFailed, err)
 	}
-
-	return response, nil
+	notifyObservers(Exchange{Start: now, Attempt: attempt, Request: req, RequestBody: body, Response: response, Err: err})
+	return response, err
 }
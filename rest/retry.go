@@ -0,0 +1,153 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RetryDecision int
+
+const (
+	// Let the policy decide from the status code or error
+	RetryDefault RetryDecision = iota
+	// Retry (subject to the attempt and time limits) after the policy's delay
+	RetryNow
+	// Return this response or error as-is
+	RetryStop
+)
+
+// Called after every attempt. It may change opt (for example the body) before
+// the next attempt. attempt starts at 1.
+type RetryHook func(ctx context.Context, attempt int, opt *RequestOptions, resp Response, err error) RetryDecision
+
+type RetryPolicy struct {
+	// Zero means no limit. With both limits at zero, retries go on until the
+	// request succeeds or the context is cancelled.
+	MaxAttempts int
+	MaxElapsed  time.Duration
+	// Delay before the first retry, doubled for every further attempt up to
+	// MaxDelay. Jitter is the fraction of the delay that is randomised.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Jitter    float64
+	// Status codes that are retried
+	RetryStatuses map[int]bool
+	// Retry when the request could not be sent or the response not read
+	RetryNetworkErrors bool
+	// Use the delay from a Retry-After header when it is longer
+	HonourRetryAfter bool
+	Hook             RetryHook
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:        8,
+		MaxElapsed:         5 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           time.Minute,
+		Jitter:             0.5,
+		RetryStatuses:      map[int]bool{429: true, 502: true, 503: true, 504: true},
+		RetryNetworkErrors: true,
+		HonourRetryAfter:   true,
+	}
+}
+
+// Copy of p that also retries the given status codes.
+func (p *RetryPolicy) WithStatuses(codes ...int) *RetryPolicy {
+	cp := *p
+	cp.RetryStatuses = map[int]bool{}
+	for code, retry := range p.RetryStatuses {
+		cp.RetryStatuses[code] = retry
+	}
+	for _, code := range codes {
+		cp.RetryStatuses[code] = true
+	}
+	return &cp
+}
+
+// Copy of p with a hook for custom retry decisions.
+func (p *RetryPolicy) WithHook(hook RetryHook) *RetryPolicy {
+	cp := *p
+	cp.Hook = hook
+	return &cp
+}
+
+// Works out whether another attempt should be made, and after how long.
+func (p *RetryPolicy) next(ctx context.Context, attempt int, start time.Time, opt *RequestOptions, resp Response, err error) (bool, time.Duration) {
+	if p == nil || ctx.Err() != nil {
+		return false, 0
+	}
+
+	decision := RetryDefault
+	if p.Hook != nil {
+		decision = p.Hook(ctx, attempt, opt, resp, err)
+	}
+	switch decision {
+	case RetryStop:
+		return false, 0
+	case RetryDefault:
+		if err != nil && !p.RetryNetworkErrors {
+			return false, 0
+		}
+		if err == nil && !p.RetryStatuses[resp.StatusCode] {
+			return false, 0
+		}
+	}
+
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return false, 0
+	}
+
+	delay := p.backoff(attempt)
+	if p.HonourRetryAfter && err == nil {
+		if after, ok := retryAfter(resp.Header); ok && after > delay {
+			delay = after
+		}
+	}
+
+	if p.MaxElapsed > 0 && time.Since(start)+delay > p.MaxElapsed {
+		return false, 0
+	}
+	return true, delay
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.Jitter > 0 && delay > 0 {
+		spread := float64(delay) * p.Jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+	// Capped after the jitter, so MaxDelay is a hard limit
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return max(delay, 0)
+}
+
+func retryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+func describeAttempt(resp Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("status %d", resp.StatusCode)
+}
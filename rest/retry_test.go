@@ -0,0 +1,165 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		// Must not overflow
+		{200, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := policy.backoff(test.attempt); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempt  int
+		min, max time.Duration
+	}{
+		{"spread around the delay", RetryPolicy{BaseDelay: time.Second, Jitter: 0.5}, 1, 500 * time.Millisecond, 1500 * time.Millisecond},
+		{"capped after jitter", RetryPolicy{BaseDelay: time.Second, MaxDelay: 4 * time.Second, Jitter: 0.5}, 3, 2 * time.Second, 4 * time.Second},
+		{"full jitter never goes negative", RetryPolicy{BaseDelay: time.Second, Jitter: 1.5}, 1, 0, 2500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for range 1000 {
+				if got := test.policy.backoff(test.attempt); got < test.min || got > test.max {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", test.attempt, got, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryNext(t *testing.T) {
+	netErr := errors.New("connection reset")
+	retryAfter := http.Header{"Retry-After": []string{"30"}}
+	tests := []struct {
+		name      string
+		policy    *RetryPolicy
+		attempt   int
+		status    int
+		header    http.Header
+		err       error
+		wantRetry bool
+		wantDelay time.Duration
+	}{
+		{"no policy", nil, 1, 503, nil, nil, false, 0},
+		{"retried status", &RetryPolicy{BaseDelay: time.Second, RetryStatuses: map[int]bool{503: true}}, 1, 503, nil, nil, true, time.Second},
+		{"other status", &RetryPolicy{BaseDelay: time.Second, RetryStatuses: map[int]bool{503: true}}, 1, 404, nil, nil, false, 0},
+		{"network error", &RetryPolicy{BaseDelay: time.Second, RetryNetworkErrors: true}, 2, 0, nil, netErr, true, 2 * time.Second},
+		{"network errors not retried", &RetryPolicy{BaseDelay: time.Second}, 1, 0, nil, netErr, false, 0},
+		{"out of attempts", &RetryPolicy{MaxAttempts: 3, RetryStatuses: map[int]bool{503: true}}, 3, 503, nil, nil, false, 0},
+		{"longer Retry-After", &RetryPolicy{BaseDelay: time.Second, RetryStatuses: map[int]bool{429: true}, HonourRetryAfter: true}, 1, 429, retryAfter, nil, true, 30 * time.Second},
+		{"Retry-After ignored", &RetryPolicy{BaseDelay: time.Second, RetryStatuses: map[int]bool{429: true}}, 1, 429, retryAfter, nil, true, time.Second},
+		{"past the time limit", &RetryPolicy{MaxElapsed: 10 * time.Second, RetryStatuses: map[int]bool{429: true}, HonourRetryAfter: true}, 1, 429, retryAfter, nil, false, 0},
+		{"hook stops", (&RetryPolicy{RetryStatuses: map[int]bool{503: true}}).WithHook(func(context.Context, int, *RequestOptions, Response, error) RetryDecision { return RetryStop }), 1, 503, nil, nil, false, 0},
+		{"hook retries", (&RetryPolicy{BaseDelay: time.Second}).WithHook(func(context.Context, int, *RequestOptions, Response, error) RetryDecision { return RetryNow }), 1, 504, nil, nil, true, time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := Response{StatusCode: test.status, Header: test.header}
+			retry, delay := test.policy.next(context.Background(), test.attempt, time.Now(), &RequestOptions{}, resp, test.err)
+			if retry != test.wantRetry || delay != test.wantDelay {
+				t.Errorf("next() = %v, %s, want %v, %s", retry, delay, test.wantRetry, test.wantDelay)
+			}
+		})
+	}
+}
+
+func TestRetryAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		opt    RequestOptions
+		status int
+		err    error
+		want   bool
+	}{
+		{"GET after 503", RequestOptions{Method: "GET"}, 503, nil, true},
+		{"default method", RequestOptions{}, 503, nil, true},
+		{"PUT after network error", RequestOptions{Method: "PUT"}, 0, errors.New("reset"), true},
+		{"POST after 503", RequestOptions{Method: "POST"}, 503, nil, false},
+		{"POST after network error", RequestOptions{Method: "post"}, 0, errors.New("reset"), false},
+		{"POST after 429", RequestOptions{Method: "POST"}, 429, nil, true},
+		{"PATCH after 429", RequestOptions{Method: "PATCH"}, 429, nil, true},
+		{"idempotency key alone", RequestOptions{Method: "POST", IdempotencyKey: "key"}, 503, nil, false},
+		{"opted in", RequestOptions{Method: "POST", RetryNonIdempotent: true}, 503, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.opt.retryAllowed(Response{StatusCode: test.status}, test.err); got != test.want {
+				t.Errorf("retryAllowed() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestRetries(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, RetryStatuses: map[int]bool{429: true, 503: true}}
+	tests := []struct {
+		name         string
+		method       string
+		status       int
+		nonIdem      bool
+		wantAttempts int32
+	}{
+		{"GET retried until out of attempts", "GET", 503, false, 3},
+		{"POST not retried after 503", "POST", 503, false, 1},
+		{"POST retried after 429", "POST", 429, false, 3},
+		{"POST opted in", "POST", 503, true, 3},
+		{"success", "GET", 200, false, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			keys := map[string]bool{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				keys[r.Header.Get("Idempotency-Key")] = true
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			_, err := Request(context.Background(), server.URL, &RequestOptions{
+				Method:             test.method,
+				Retry:              policy,
+				RetryNonIdempotent: test.nonIdem,
+			}, nil, server.Client())
+			if (err == nil) != (test.status == 200) {
+				t.Errorf("Request() error = %v", err)
+			}
+			if got := attempts.Load(); got != test.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, test.wantAttempts)
+			}
+			// Every attempt of a POST carries the same key
+			if test.method == "POST" && (len(keys) != 1 || keys[""]) {
+				t.Errorf("idempotency keys %v, want one", keys)
+			}
+			if test.method == "GET" && !keys[""] {
+				t.Errorf("GET sent idempotency keys %v", keys)
+			}
+		})
+	}
+}
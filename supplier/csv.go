@@ -0,0 +1,238 @@
+package supplier
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RoundRobinHood/jouma-data-migration/feedfile"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+// Product fields a CSV column can be mapped to
+var CSVFields = []string{
+	"sku", "part_number", "barcode", "name", "description", "product_type",
+	"manufacturer", "category", "stock", "price", "list_price", "image_url",
+	"eta", "discounted", "width", "height", "length", "weight",
+}
+
+// How to read a supplier's CSV feed, usually loaded from a JSON file:
+//
+//	{
+//	  "supplier": "acme",
+//	  "delimiter": ";",
+//	  "decimal_comma": true,
+//	  "columns": {"sku": "Item Code", "name": "Title", "price": "Cost", "stock": "Qty"}
+//	}
+type CSVConfig struct {
+	Supplier string `json:"supplier"`
+	// Prepended to every SKU, for suppliers whose SKUs clash with another's
+	SKUPrefix string `json:"sku_prefix"`
+	// A single character, "," by default
+	Delimiter string `json:"delimiter"`
+	// Maps product fields (see CSVFields) to column headers. Unmapped fields
+	// are left empty.
+	Columns map[string]string `json:"columns"`
+	// Prices and dimensions are written like "1 234,50"
+	DecimalComma bool `json:"decimal_comma"`
+	// Layout of the eta column, in Go's reference time notation. "2006-01-02"
+	// by default.
+	DateLayout string `json:"date_layout"`
+	// Values of the discounted column that mean true, case-insensitive.
+	// "yes", "y", "true" and "1" by default.
+	TrueValues []string `json:"true_values"`
+}
+
+func LoadCSVConfig(path string) (CSVConfig, error) {
+	var cnf CSVConfig
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return cnf, err
+	}
+	if err := json.Unmarshal(bytes, &cnf); err != nil {
+		return cnf, fmt.Errorf("invalid CSV config: %w", err)
+	}
+	return cnf, nil
+}
+
+// A CSV feed file with a header row, optionally gzipped.
+type CSV struct {
+	Path   string
+	Config CSVConfig
+	read   int64
+}
+
+func NewCSV(path string, cnf CSVConfig) (*CSV, error) {
+	if cnf.Supplier == "" {
+		return nil, errors.New("CSV config has no supplier name")
+	}
+	if cnf.Delimiter != "" && utf8.RuneCountInString(cnf.Delimiter) != 1 {
+		return nil, fmt.Errorf("CSV delimiter %q is not a single character", cnf.Delimiter)
+	}
+	if cnf.Columns["sku"] == "" {
+		return nil, errors.New("CSV config doesn't map a column to sku")
+	}
+	for field := range cnf.Columns {
+		known := false
+		for _, name := range CSVFields {
+			known = known || name == field
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown product field %q in CSV config", field)
+		}
+	}
+	if cnf.DateLayout == "" {
+		cnf.DateLayout = "2006-01-02"
+	}
+	if len(cnf.TrueValues) == 0 {
+		cnf.TrueValues = []string{"yes", "y", "true", "1"}
+	}
+	return &CSV{Path: path, Config: cnf}, nil
+}
+
+func (c *CSV) Name() string {
+	return c.Config.Supplier
+}
+
+func (c *CSV) BytesRead() int64 {
+	return c.read
+}
+
+func (c *CSV) number(value string) string {
+	value = strings.ReplaceAll(strings.TrimSpace(value), " ", "")
+	if c.Config.DecimalComma {
+		return strings.ReplaceAll(strings.ReplaceAll(value, ".", ""), ",", ".")
+	}
+	return strings.ReplaceAll(value, ",", "")
+}
+
+// Converts one record, given the index of each mapped field's column. Fields
+// that can't be parsed are left at zero and returned as a RowError.
+func (c *CSV) product(record []string, index map[string]int) (types.Product, error) {
+	get := func(field string) string {
+		if i, ok := index[field]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	rowErr := &RowError{}
+	float := func(field string) float64 {
+		value := c.number(get(field))
+		if value == "" {
+			return 0
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			rowErr.Invalid = append(rowErr.Invalid, InvalidField{Field: field, Value: get(field)})
+			return 0
+		}
+		return f
+	}
+
+	product := types.Product{
+		Supplier:     c.Config.Supplier,
+		SKU:          c.Config.SKUPrefix + get("sku"),
+		PartNumber:   get("part_number"),
+		Barcode:      get("barcode"),
+		Name:         get("name"),
+		Description:  get("description"),
+		ProductType:  get("product_type"),
+		Manufacturer: get("manufacturer"),
+		Category:     get("category"),
+		// Checked by the validator rather than here
+		Price:     types.PriceString(c.number(get("price"))),
+		ListPrice: types.PriceString(c.number(get("list_price"))),
+		ImageURL:  get("image_url"),
+		Stock:     int(float("stock")),
+		Width:     float("width"),
+		Height:    float("height"),
+		Length:    float("length"),
+		Weight:    float("weight"),
+	}
+
+	if eta := get("eta"); eta != "" {
+		t, err := time.Parse(c.Config.DateLayout, eta)
+		if err != nil {
+			rowErr.Invalid = append(rowErr.Invalid, InvalidField{Field: "eta", Value: eta})
+		} else {
+			product.ETA = &t
+		}
+	}
+	for _, value := range c.Config.TrueValues {
+		if strings.EqualFold(get("discounted"), value) {
+			product.Discounted = true
+		}
+	}
+
+	if len(rowErr.Invalid) != 0 {
+		return product, rowErr
+	}
+	return product, nil
+}
+
+func (c *CSV) Products() iter.Seq2[types.Product, error] {
+	return func(yield func(types.Product, error) bool) {
+		fail := func(err error) {
+			yield(types.Product{}, fmt.Errorf("invalid %s feed: %w", c.Config.Supplier, err))
+		}
+
+		file, err := feedfile.Open(c.Path)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer file.Close()
+		counter := &feedfile.CountingReader{Reader: file}
+		defer func() { c.read = counter.N }()
+
+		reader := csv.NewReader(counter)
+		if c.Config.Delimiter != "" {
+			reader.Comma, _ = utf8.DecodeRuneInString(c.Config.Delimiter)
+		}
+		reader.FieldsPerRecord = -1
+		reader.ReuseRecord = true
+
+		header, err := reader.Read()
+		if err != nil {
+			fail(fmt.Errorf("failed to read header: %w", err))
+			return
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			// Spreadsheet exports often start with a byte order mark
+			columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+		}
+		index := map[string]int{}
+		for field, column := range c.Config.Columns {
+			i, ok := columns[column]
+			if !ok {
+				fail(fmt.Errorf("no %q column for %s", column, field))
+				return
+			}
+			index[field] = i
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			// A RowError only rejects this row
+			if !yield(c.product(record, index)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package supplier
+
+import (
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+func writeFeed(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if strings.HasSuffix(name, ".gz") {
+		writer := gzip.NewWriter(file)
+		defer writer.Close()
+		_, err = writer.Write([]byte(content))
+	} else {
+		_, err = file.WriteString(content)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type csvRow struct {
+	product types.Product
+	invalid []InvalidField
+}
+
+func readCSV(t *testing.T, name, content string, cnf CSVConfig) ([]csvRow, error) {
+	t.Helper()
+	source, err := NewCSV(writeFeed(t, name, content), cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]csvRow, 0)
+	for product, err := range source.Products() {
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			rows = append(rows, csvRow{product, rowErr.Invalid})
+			continue
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, csvRow{product: product})
+	}
+	return rows, nil
+}
+
+func TestCSVProducts(t *testing.T) {
+	columns := map[string]string{"sku": "Code", "name": "Title", "price": "Cost", "stock": "Qty"}
+	eta := time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		cnf     CSVConfig
+		want    []csvRow
+	}{
+		{"plain", "feed.csv",
+			"Code,Title,Cost,Qty\nA1,Cable,\"1,299.50\",4\n",
+			CSVConfig{Columns: columns},
+			[]csvRow{{product: types.Product{SKU: "A1", Name: "Cable", Price: "1299.50", Stock: 4}}}},
+		{"decimal comma and delimiter", "feed.csv",
+			"Code;Title;Cost;Qty\nA1;Cable;1.299,50;4\nA2;Plug;12,5;0\n",
+			CSVConfig{Columns: columns, Delimiter: ";", DecimalComma: true},
+			[]csvRow{
+				{product: types.Product{SKU: "A1", Name: "Cable", Price: "1299.50", Stock: 4}},
+				{product: types.Product{SKU: "A2", Name: "Plug", Price: "12.5"}},
+			}},
+		{"byte order mark and padded headers", "feed.csv",
+			"\ufeffCode, Title ,Cost,Qty\n A1 ,Cable,10,1\n",
+			CSVConfig{Columns: columns},
+			[]csvRow{{product: types.Product{SKU: "A1", Name: "Cable", Price: "10", Stock: 1}}}},
+		{"SKU prefix", "feed.csv",
+			"Code,Title,Cost,Qty\nA1,Cable,10,1\n",
+			CSVConfig{Columns: columns, SKUPrefix: "AC-"},
+			[]csvRow{{product: types.Product{SKU: "AC-A1", Name: "Cable", Price: "10", Stock: 1}}}},
+		{"gzipped", "feed.csv.gz",
+			"Code,Title,Cost,Qty\nA1,Cable,10,1\n",
+			CSVConfig{Columns: columns},
+			[]csvRow{{product: types.Product{SKU: "A1", Name: "Cable", Price: "10", Stock: 1}}}},
+		{"discounted and ETA", "feed.csv",
+			"Code,Sale,Due\nA1,JA,14/03/2026\nA2,nee,\n",
+			CSVConfig{Columns: map[string]string{"sku": "Code", "discounted": "Sale", "eta": "Due"}, TrueValues: []string{"ja"}, DateLayout: "02/01/2006"},
+			[]csvRow{
+				{product: types.Product{SKU: "A1", Discounted: true, ETA: &eta}},
+				{product: types.Product{SKU: "A2"}},
+			}},
+		{"default true values", "feed.csv",
+			"Code,Sale\nA1,Yes\nA2,1\nA3,no\n",
+			CSVConfig{Columns: map[string]string{"sku": "Code", "discounted": "Sale"}},
+			[]csvRow{
+				{product: types.Product{SKU: "A1", Discounted: true}},
+				{product: types.Product{SKU: "A2", Discounted: true}},
+				{product: types.Product{SKU: "A3"}},
+			}},
+		{"invalid fields reject only their row", "feed.csv",
+			"Code,Title,Cost,Qty,Due\nA1,Cable,10,lots,2026-13-01\nA2,Plug,5,2,\n",
+			CSVConfig{Columns: map[string]string{"sku": "Code", "name": "Title", "price": "Cost", "stock": "Qty", "eta": "Due"}},
+			[]csvRow{
+				{types.Product{SKU: "A1", Name: "Cable", Price: "10"}, []InvalidField{{Field: "stock", Value: "lots"}, {Field: "eta", Value: "2026-13-01"}}},
+				{product: types.Product{SKU: "A2", Name: "Plug", Price: "5", Stock: 2}},
+			}},
+		{"short rows", "feed.csv",
+			"Code,Title,Cost,Qty\nA1,Cable\n",
+			CSVConfig{Columns: columns},
+			[]csvRow{{product: types.Product{SKU: "A1", Name: "Cable"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cnf.Supplier = "acme"
+			rows, err := readCSV(t, test.file, test.content, test.cnf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(test.want) {
+				t.Fatalf("read %d rows, want %d", len(rows), len(test.want))
+			}
+			for i, want := range test.want {
+				got := rows[i]
+				want.product.Supplier = "acme"
+				if (got.product.ETA == nil) != (want.product.ETA == nil) || (got.product.ETA != nil && !got.product.ETA.Equal(*want.product.ETA)) {
+					t.Errorf("row %d ETA = %v, want %v", i, got.product.ETA, want.product.ETA)
+				}
+				got.product.ETA, want.product.ETA = nil, nil
+				if got.product != want.product {
+					t.Errorf("row %d = %+v\nwant %+v", i, got.product, want.product)
+				}
+				if len(got.invalid) != len(want.invalid) {
+					t.Fatalf("row %d invalid fields %v, want %v", i, got.invalid, want.invalid)
+				}
+				for j := range want.invalid {
+					if got.invalid[j] != want.invalid[j] {
+						t.Errorf("row %d invalid fields %v, want %v", i, got.invalid, want.invalid)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCSVMissingColumn(t *testing.T) {
+	_, err := readCSV(t, "feed.csv", "Code,Title\nA1,Cable\n", CSVConfig{Supplier: "acme", Columns: map[string]string{"sku": "Code", "price": "Cost"}})
+	if err == nil || !strings.Contains(err.Error(), `no "Cost" column for price`) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		cnf  CSVConfig
+	}{
+		{"no supplier", CSVConfig{Columns: map[string]string{"sku": "Code"}}},
+		{"long delimiter", CSVConfig{Supplier: "acme", Delimiter: "||", Columns: map[string]string{"sku": "Code"}}},
+		{"no SKU column", CSVConfig{Supplier: "acme", Columns: map[string]string{"name": "Title"}}},
+		{"unknown field", CSVConfig{Supplier: "acme", Columns: map[string]string{"sku": "Code", "colour": "Colour"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewCSV("feed.csv", test.cnf); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package supplier
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+// Matches products on which all of its set conditions hold. Text conditions
+// are lists of case-insensitive patterns where '*' matches any run of
+// characters and '?' any one character; one matching pattern is enough.
+// Price and stock bounds are inclusive.
+type FilterRule struct {
+	// Used in the run summary. "include 1", "exclude 2", ... by default.
+	Name         string   `json:"name"`
+	Category     []string `json:"category"`
+	Manufacturer []string `json:"manufacturer"`
+	ProductType  []string `json:"product_type"`
+	SKU          []string `json:"sku"`
+	MinPrice     *float64 `json:"min_price"`
+	MaxPrice     *float64 `json:"max_price"`
+	MinStock     *int     `json:"min_stock"`
+	MaxStock     *int     `json:"max_stock"`
+
+	patterns [4][]*regexp.Regexp
+}
+
+func globPattern(glob string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(strings.TrimSpace(glob))
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.Compile("(?is)^" + pattern + "$")
+}
+
+func (r *FilterRule) compile() error {
+	fields := [4][]string{r.Category, r.Manufacturer, r.ProductType, r.SKU}
+	empty := r.MinPrice == nil && r.MaxPrice == nil && r.MinStock == nil && r.MaxStock == nil
+	for i, globs := range fields {
+		r.patterns[i] = make([]*regexp.Regexp, 0, len(globs))
+		for _, glob := range globs {
+			pattern, err := globPattern(glob)
+			if err != nil {
+				return fmt.Errorf("rule %q: invalid pattern %q: %w", r.Name, glob, err)
+			}
+			r.patterns[i] = append(r.patterns[i], pattern)
+		}
+		empty = empty && len(globs) == 0
+	}
+	if empty {
+		return fmt.Errorf("rule %q has no conditions", r.Name)
+	}
+	return nil
+}
+
+func (r *FilterRule) Matches(product types.Product) bool {
+	values := [4]string{product.Category, product.Manufacturer, product.ProductType, product.SKU}
+	for i, patterns := range r.patterns {
+		if len(patterns) == 0 {
+			continue
+		}
+		matched := false
+		for _, pattern := range patterns {
+			matched = matched || pattern.MatchString(strings.TrimSpace(values[i]))
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if r.MinPrice != nil || r.MaxPrice != nil {
+		price, ok := product.Price.Float()
+		if !ok || (r.MinPrice != nil && price < *r.MinPrice) || (r.MaxPrice != nil && price > *r.MaxPrice) {
+			return false
+		}
+	}
+	if r.MinStock != nil && product.Stock < *r.MinStock {
+		return false
+	}
+	if r.MaxStock != nil && product.Stock > *r.MaxStock {
+		return false
+	}
+	return true
+}
+
+// Decides which feed products belong in the shop, usually loaded from a JSON
+// file:
+//
+//	{
+//	  "include": [{"name": "R50 and up", "min_price": 50}],
+//	  "exclude": [
+//	    {"name": "consumables", "category": ["Consumables*", "*Toner*"]},
+//	    {"manufacturer": ["Generic"]},
+//	    {"sku": ["*-REFURB"]}
+//	  ]
+//	}
+//
+// A product is kept if it matches any include rule (or there are none) and
+// no exclude rule.
+type ProductFilter struct {
+	Include []FilterRule `json:"include"`
+	Exclude []FilterRule `json:"exclude"`
+
+	report FilterReport
+}
+
+type FilterReport struct {
+	Products int
+	Kept     int
+	// Products left out by each exclude rule, or by matching no include rule
+	Removed map[string]int
+}
+
+// Products that matched no include rule
+const NotIncluded = "no include rule"
+
+func LoadFilter(path string) (*ProductFilter, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var filter ProductFilter
+	if err := json.Unmarshal(bytes, &filter); err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	for _, rules := range []struct {
+		kind  string
+		rules []FilterRule
+	}{{"include", filter.Include}, {"exclude", filter.Exclude}} {
+		for i := range rules.rules {
+			if rules.rules[i].Name == "" {
+				rules.rules[i].Name = fmt.Sprintf("%s %d", rules.kind, i+1)
+			}
+			if err := rules.rules[i].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &filter, nil
+}
+
+// Reports whether product should be kept, and if not, the name of the rule
+// that removed it.
+func (f *ProductFilter) Keep(product types.Product) (bool, string) {
+	if len(f.Include) != 0 {
+		included := false
+		for i := range f.Include {
+			if f.Include[i].Matches(product) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false, NotIncluded
+		}
+	}
+	for i := range f.Exclude {
+		if f.Exclude[i].Matches(product) {
+			return false, f.Exclude[i].Name
+		}
+	}
+	return true, ""
+}
+
+// Yields the products that are kept. Errors are passed through. Each
+// iteration starts a fresh report, so the feed can be read again.
+func (f *ProductFilter) Apply(products iter.Seq2[types.Product, error]) iter.Seq2[types.Product, error] {
+	return func(yield func(types.Product, error) bool) {
+		f.report = FilterReport{Removed: map[string]int{}}
+		for product, err := range products {
+			if err != nil {
+				yield(product, err)
+				return
+			}
+			f.report.Products++
+			keep, rule := f.Keep(product)
+			if !keep {
+				f.report.Removed[rule]++
+				continue
+			}
+			f.report.Kept++
+			if !yield(product, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (f *ProductFilter) Report() FilterReport {
+	return f.report
+}
+
+func PrintFilterSummary(report FilterReport) {
+	fmt.Printf("Filtered %d products: %d kept, %d left out\n", report.Products, report.Kept, report.Products-report.Kept)
+	rules := make([]string, 0, len(report.Removed))
+	for rule := range report.Removed {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		fmt.Printf("  %s: %d\n", rule, report.Removed[rule])
+	}
+}
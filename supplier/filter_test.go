@@ -0,0 +1,161 @@
+package supplier
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		glob  string
+		value string
+		want  bool
+	}{
+		{"Toner", "toner", true},
+		{"Toner", "Toner cartridge", false},
+		{"*Toner*", "HP Toner Black", true},
+		{"Consumables*", "Consumables > Ink", true},
+		{"Consumables*", "IT Consumables", false},
+		{"*-REFURB", "AB12-refurb", true},
+		{"AB??", "AB12", true},
+		{"AB??", "AB123", false},
+		{"  Cables ", "Cables", true},
+		{"C++ (books)", "c++ (books)", true},
+		{"a.b", "axb", false},
+		{"[x]", "x", false},
+		{"*", "", true},
+		{"*", "line one\nline two", true},
+	}
+	for _, test := range tests {
+		t.Run(test.glob+"/"+test.value, func(t *testing.T) {
+			pattern, err := globPattern(test.glob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pattern.MatchString(test.value); got != test.want {
+				t.Errorf("%q matches %q = %v, want %v", test.glob, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestKeep(t *testing.T) {
+	product := types.Product{
+		SKU:          "AB12-REFURB",
+		Category:     "Consumables > Toner",
+		Manufacturer: "HP",
+		ProductType:  "Cartridge",
+		Price:        "250.00",
+		Stock:        4,
+	}
+	tests := []struct {
+		name     string
+		filter   ProductFilter
+		want     bool
+		wantRule string
+	}{
+		{"no rules", ProductFilter{}, true, ""},
+		{"excluded category", ProductFilter{Exclude: []FilterRule{{Name: "toner", Category: []string{"*toner*"}}}}, false, "toner"},
+		{"any pattern in a list", ProductFilter{Exclude: []FilterRule{{Name: "brands", Manufacturer: []string{"Canon", "hp"}}}}, false, "brands"},
+		{"all conditions must hold", ProductFilter{Exclude: []FilterRule{{Name: "hp ink", Manufacturer: []string{"HP"}, ProductType: []string{"Ink"}}}}, true, ""},
+		{"first matching exclude rule", ProductFilter{Exclude: []FilterRule{{Name: "other", SKU: []string{"XY*"}}, {Name: "refurb", SKU: []string{"*-refurb"}}, {Name: "hp", Manufacturer: []string{"HP"}}}}, false, "refurb"},
+		{"included", ProductFilter{Include: []FilterRule{{Name: "hp", Manufacturer: []string{"HP"}}}}, true, ""},
+		{"not included", ProductFilter{Include: []FilterRule{{Name: "canon", Manufacturer: []string{"Canon"}}}}, false, NotIncluded},
+		{"exclude wins over include", ProductFilter{Include: []FilterRule{{Name: "hp", Manufacturer: []string{"HP"}}}, Exclude: []FilterRule{{Name: "refurb", SKU: []string{"*-REFURB"}}}}, false, "refurb"},
+		{"min price is inclusive", ProductFilter{Include: []FilterRule{{Name: "250 and up", MinPrice: ptr(250.0)}}}, true, ""},
+		{"below min price", ProductFilter{Include: []FilterRule{{Name: "300 and up", MinPrice: ptr(300.0)}}}, false, NotIncluded},
+		{"above max price", ProductFilter{Exclude: []FilterRule{{Name: "cheap", MaxPrice: ptr(100.0)}}}, true, ""},
+		{"within max stock", ProductFilter{Exclude: []FilterRule{{Name: "low stock", MaxStock: ptr(4)}}}, false, "low stock"},
+		{"below min stock", ProductFilter{Include: []FilterRule{{Name: "plenty", MinStock: ptr(10)}}}, false, NotIncluded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, rules := range [][]FilterRule{test.filter.Include, test.filter.Exclude} {
+				for i := range rules {
+					if err := rules[i].compile(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			keep, rule := test.filter.Keep(product)
+			if keep != test.want || rule != test.wantRule {
+				t.Errorf("Keep = %v, %q, want %v, %q", keep, rule, test.want, test.wantRule)
+			}
+		})
+	}
+}
+
+func TestUnreadablePriceFailsBounds(t *testing.T) {
+	rule := FilterRule{MinPrice: ptr(0.0)}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Matches(types.Product{Price: "POA"}) {
+		t.Error("a price bound matched a price that can't be read")
+	}
+}
+
+func TestLoadFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"valid", `{"include": [{"min_price": 50}], "exclude": [{"category": ["Toner*"]}]}`, false},
+		{"rule without conditions", `{"exclude": [{"name": "everything"}]}`, true},
+		{"rule with empty lists", `{"exclude": [{"category": []}]}`, true},
+		{"invalid JSON", `{"exclude": [`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "filter.json")
+			if err := os.WriteFile(path, []byte(test.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			filter, err := LoadFilter(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, test.wantErr)
+			}
+			if err == nil && (filter.Include[0].Name != "include 1" || filter.Exclude[0].Name != "exclude 1") {
+				t.Errorf("default names %q and %q", filter.Include[0].Name, filter.Exclude[0].Name)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	filter := ProductFilter{Exclude: []FilterRule{{Name: "toner", Category: []string{"Toner"}}}}
+	if err := filter.Exclude[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+	products := filter.Apply(feed(
+		types.Product{SKU: "A1", Category: "Cables"},
+		types.Product{SKU: "B1", Category: "Toner"},
+		types.Product{SKU: "C1", Category: "Cables"},
+	))
+	// Read twice to check that the report starts over
+	for range 2 {
+		kept := 0
+		for _, err := range products {
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept++
+		}
+		if kept != 2 {
+			t.Errorf("kept %d products, want 2", kept)
+		}
+	}
+	report := filter.Report()
+	if report.Products != 3 || report.Kept != 2 || !maps.Equal(report.Removed, map[string]int{"toner": 1}) {
+		t.Errorf("report = %+v", report)
+	}
+}
@@ -0,0 +1,293 @@
+package supplier
+
+import (
+	"fmt"
+	"iter"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+// Decides between two offers for the same item. Rules are tried in order
+// until one prefers an offer.
+type MergeRule string
+
+const (
+	// Offers with stock beat those without
+	InStock MergeRule = "in_stock"
+	// The lowest price wins
+	Cheapest MergeRule = "cheapest"
+	// The supplier listed first in MergeOptions.Preferred wins
+	Preferred MergeRule = "preferred"
+	// The offer available soonest wins. Offers in stock are available now.
+	SoonestETA MergeRule = "eta"
+)
+
+func ParseMergeRules(s string) ([]MergeRule, error) {
+	rules := make([]MergeRule, 0)
+	for _, name := range strings.Split(s, ",") {
+		rule := MergeRule(strings.ToLower(strings.TrimSpace(name)))
+		switch rule {
+		case "":
+			continue
+		case InStock, Cheapest, Preferred, SoonestETA:
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("unknown merge rule %q: expected 'in_stock', 'cheapest', 'preferred' or 'eta'", name)
+		}
+	}
+	return rules, nil
+}
+
+type MergeOptions struct {
+	Rules []MergeRule
+	// Supplier names, most preferred first
+	Preferred []string
+	// Publish the stock of all offers instead of only the winner's
+	SumStock bool
+}
+
+// Returns <0 if a should win over b, >0 if b should, 0 if the rule can't
+// decide.
+func (o MergeOptions) compare(rule MergeRule, a, b types.Product) int {
+	switch rule {
+	case InStock:
+		return boolRank(a.Stock > 0) - boolRank(b.Stock > 0)
+	case Cheapest:
+		return floatCompare(priceRank(a), priceRank(b))
+	case Preferred:
+		return o.preference(a.Supplier) - o.preference(b.Supplier)
+	case SoonestETA:
+		return floatCompare(etaRank(a), etaRank(b))
+	}
+	return 0
+}
+
+func (o MergeOptions) preference(supplier string) int {
+	for i, name := range o.Preferred {
+		if strings.EqualFold(name, supplier) {
+			return i
+		}
+	}
+	return len(o.Preferred)
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 0
+	}
+	return 1
+}
+
+func floatCompare(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func priceRank(product types.Product) float64 {
+	if price, ok := product.Price.Float(); ok {
+		return price
+	}
+	return math.Inf(1)
+}
+
+func etaRank(product types.Product) float64 {
+	if product.Stock > 0 {
+		return math.Inf(-1)
+	}
+	if product.ETA == nil {
+		return math.Inf(1)
+	}
+	return float64(product.ETA.Unix())
+}
+
+// Keys that identify the same item across suppliers
+func matchKeys(product types.Product) []string {
+	keys := make([]string, 0, 2)
+	if barcode := strings.TrimSpace(product.Barcode); barcode != "" {
+		keys = append(keys, "barcode:"+barcode)
+	}
+	if part := strings.ToUpper(strings.TrimSpace(product.PartNumber)); part != "" {
+		keys = append(keys, "part:"+part)
+	}
+	return keys
+}
+
+// Offers for one item, at most one per supplier, in feed order.
+type offerGroup []types.Product
+
+func (g offerGroup) has(supplier string) bool {
+	for _, offer := range g {
+		if offer.Supplier == supplier {
+			return true
+		}
+	}
+	return false
+}
+
+// Publishes one product for the group. It keeps the SKU and descriptive
+// fields of the first feed's offer, so the WC product stays put when another
+// supplier starts winning, and takes price, stock and availability from the
+// winning offer.
+func (o MergeOptions) merge(group offerGroup) types.Product {
+	ranked := append(offerGroup{}, group...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		for _, rule := range o.Rules {
+			if c := o.compare(rule, ranked[i], ranked[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	winner := ranked[0]
+
+	merged := group[0]
+	for _, offer := range group[1:] {
+		fields := []struct{ dst, src *string }{
+			{&merged.Name, &offer.Name},
+			{&merged.Description, &offer.Description},
+			{&merged.ProductType, &offer.ProductType},
+			{&merged.Manufacturer, &offer.Manufacturer},
+			{&merged.Category, &offer.Category},
+			{&merged.ImageURL, &offer.ImageURL},
+		}
+		for _, field := range fields {
+			if *field.dst == "" {
+				*field.dst = *field.src
+			}
+		}
+	}
+
+	merged.Supplier = winner.Supplier
+	merged.SupplierSKU = winner.SKU
+	merged.Price = winner.Price
+	merged.ListPrice = winner.ListPrice
+	merged.Stock = winner.Stock
+	merged.ETA = winner.ETA
+	merged.Discounted = winner.Discounted
+	if o.SumStock {
+		merged.Stock = 0
+		for _, offer := range group {
+			merged.Stock += max(offer.Stock, 0)
+		}
+	}
+	return merged
+}
+
+// Combines the products of several supplier feeds into one product per
+// item, keeping a report of the last merge.
+type Merger struct {
+	Options MergeOptions
+
+	report MergeReport
+}
+
+type MergeReport struct {
+	Offers    int
+	Suppliers int
+	Products  int
+	// Products offered by more than one supplier
+	Shared int
+	// Items left out because another supplier's item has the same SKU
+	Collisions []SKUCollision
+}
+
+type SKUCollision struct {
+	SKU string
+	// Supplier whose item was kept
+	Kept string
+	// Supplier whose item was left out
+	Skipped string
+}
+
+func NewMerger(opt MergeOptions) *Merger {
+	return &Merger{Options: opt}
+}
+
+// Combines feeds, listed in order of precedence. Offers from different
+// suppliers are the same item if they share a barcode or manufacturer part
+// number. The first feed error is passed through.
+//
+// Each feed is read once per iteration. Offers are held without their
+// descriptions, apart from the one description kept per item, and the merged
+// products are yielded once every feed has been read. Each iteration starts a
+// fresh report.
+func (m *Merger) Merge(feeds []iter.Seq2[types.Product, error]) iter.Seq2[types.Product, error] {
+	return func(yield func(types.Product, error) bool) {
+		m.report = MergeReport{Suppliers: len(feeds), Collisions: []SKUCollision{}}
+		groups := make([]offerGroup, 0)
+		descriptions := make([]string, 0)
+		byKey := map[string]int{}
+		for _, feed := range feeds {
+			for product, err := range feed {
+				if err != nil {
+					yield(product, err)
+					return
+				}
+				m.report.Offers++
+				keys := matchKeys(product)
+				index := -1
+				for _, key := range keys {
+					if i, ok := byKey[key]; ok && !groups[i].has(product.Supplier) {
+						index = i
+						break
+					}
+				}
+				if index == -1 {
+					index = len(groups)
+					groups = append(groups, offerGroup{})
+					descriptions = append(descriptions, "")
+				}
+				if descriptions[index] == "" {
+					descriptions[index] = product.Description
+				}
+				product.Description = ""
+				groups[index] = append(groups[index], product)
+				for _, key := range keys {
+					if _, ok := byKey[key]; !ok {
+						byKey[key] = index
+					}
+				}
+			}
+		}
+
+		skus := map[string]string{}
+		for i, group := range groups {
+			// Unrelated items from different suppliers can share a SKU
+			if supplier, ok := skus[group[0].SKU]; ok {
+				m.report.Collisions = append(m.report.Collisions, SKUCollision{SKU: group[0].SKU, Kept: supplier, Skipped: group[0].Supplier})
+				continue
+			}
+			skus[group[0].SKU] = group[0].Supplier
+			m.report.Products++
+			if len(group) > 1 {
+				m.report.Shared++
+			}
+
+			merged := m.Options.merge(group)
+			merged.Description = descriptions[i]
+			if !yield(merged, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (m *Merger) Report() MergeReport {
+	return m.report
+}
+
+func PrintMergeSummary(report MergeReport) {
+	fmt.Printf("Merged %d offers from %d suppliers into %d products (%d offered by more than one supplier)\n", report.Offers, report.Suppliers, report.Products, report.Shared)
+	for _, collision := range report.Collisions {
+		fmt.Fprintf(os.Stderr, "WARNING: SKU %q is used by both %s and %s for different items. Skipped the %s product (see sku_prefix).\n", collision.SKU, collision.Kept, collision.Skipped, collision.Skipped)
+	}
+}
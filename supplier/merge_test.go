@@ -0,0 +1,227 @@
+package supplier
+
+import (
+	"iter"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+func offer(supplier, price string, stock int, eta string) types.Product {
+	product := types.Product{
+		Supplier:   supplier,
+		SKU:        supplier + "-1",
+		PartNumber: "PN-1",
+		Price:      types.PriceString(price),
+		Stock:      stock,
+	}
+	if eta != "" {
+		at, _ := time.Parse(time.DateOnly, eta)
+		product.ETA = &at
+	}
+	return product
+}
+
+func TestParseMergeRules(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []MergeRule
+		wantErr bool
+	}{
+		{"", []MergeRule{}, false},
+		{"in_stock,cheapest", []MergeRule{InStock, Cheapest}, false},
+		{" Preferred , ETA ,", []MergeRule{Preferred, SoonestETA}, false},
+		{"cheapest,fastest", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := ParseMergeRules(test.in)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, test.wantErr)
+			}
+			if !test.wantErr && !slices.Equal(got, test.want) {
+				t.Errorf("rules = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeRanking(t *testing.T) {
+	tests := []struct {
+		name   string
+		opt    MergeOptions
+		offers []types.Product
+		want   string
+	}{
+		{"no rules keeps the first feed", MergeOptions{},
+			[]types.Product{offer("a", "200", 1, ""), offer("b", "100", 1, "")}, "a"},
+		{"cheapest", MergeOptions{Rules: []MergeRule{Cheapest}},
+			[]types.Product{offer("a", "200", 1, ""), offer("b", "100", 1, "")}, "b"},
+		{"unreadable price loses", MergeOptions{Rules: []MergeRule{Cheapest}},
+			[]types.Product{offer("a", "", 1, ""), offer("b", "100", 1, "")}, "b"},
+		{"in stock", MergeOptions{Rules: []MergeRule{InStock}},
+			[]types.Product{offer("a", "100", 0, ""), offer("b", "200", 3, "")}, "b"},
+		{"in stock before cheapest", MergeOptions{Rules: []MergeRule{InStock, Cheapest}},
+			[]types.Product{offer("a", "100", 0, ""), offer("b", "200", 3, ""), offer("c", "150", 2, "")}, "c"},
+		{"cheapest before in stock", MergeOptions{Rules: []MergeRule{Cheapest, InStock}},
+			[]types.Product{offer("a", "100", 0, ""), offer("b", "200", 3, "")}, "a"},
+		{"preferred", MergeOptions{Rules: []MergeRule{Preferred}, Preferred: []string{"C", "b"}},
+			[]types.Product{offer("a", "100", 1, ""), offer("b", "200", 1, ""), offer("c", "300", 1, "")}, "c"},
+		{"unlisted suppliers come last", MergeOptions{Rules: []MergeRule{Preferred}, Preferred: []string{"b"}},
+			[]types.Product{offer("a", "100", 1, ""), offer("b", "200", 1, "")}, "b"},
+		{"soonest ETA", MergeOptions{Rules: []MergeRule{SoonestETA}},
+			[]types.Product{offer("a", "100", 0, "2026-03-01"), offer("b", "100", 0, "2026-02-01"), offer("c", "100", 0, "")}, "b"},
+		{"stock beats any ETA", MergeOptions{Rules: []MergeRule{SoonestETA}},
+			[]types.Product{offer("a", "100", 0, "2026-02-01"), offer("b", "100", 1, "")}, "b"},
+		{"tie falls through to the next rule", MergeOptions{Rules: []MergeRule{InStock, Cheapest}},
+			[]types.Product{offer("a", "200", 1, ""), offer("b", "100", 1, "")}, "b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := test.opt.merge(test.offers)
+			if merged.Supplier != test.want {
+				t.Errorf("winner = %q, want %q", merged.Supplier, test.want)
+			}
+			if merged.SKU != test.offers[0].SKU {
+				t.Errorf("SKU = %q, want the first feed's %q", merged.SKU, test.offers[0].SKU)
+			}
+			if merged.SupplierSKU != test.want+"-1" {
+				t.Errorf("supplier SKU = %q, want the winner's", merged.SupplierSKU)
+			}
+		})
+	}
+}
+
+func TestMergeFields(t *testing.T) {
+	first := offer("a", "200", 2, "")
+	first.Name = "Cable"
+	second := offer("b", "100", -1, "")
+	second.Name = "Other name"
+	second.Manufacturer = "Acme"
+	second.ListPrice = "150"
+	second.Discounted = true
+
+	tests := []struct {
+		name string
+		opt  MergeOptions
+		want types.Product
+	}{
+		{"winner's price and stock", MergeOptions{Rules: []MergeRule{Cheapest}},
+			types.Product{Supplier: "b", SKU: "a-1", SupplierSKU: "b-1", PartNumber: "PN-1", Name: "Cable", Manufacturer: "Acme", Price: "100", ListPrice: "150", Stock: -1, Discounted: true}},
+		{"summed stock ignores negatives", MergeOptions{Rules: []MergeRule{Cheapest}, SumStock: true},
+			types.Product{Supplier: "b", SKU: "a-1", SupplierSKU: "b-1", PartNumber: "PN-1", Name: "Cable", Manufacturer: "Acme", Price: "100", ListPrice: "150", Stock: 2, Discounted: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.opt.merge(offerGroup{first, second})
+			if got.Supplier != test.want.Supplier || got.SKU != test.want.SKU || got.SupplierSKU != test.want.SupplierSKU ||
+				got.Name != test.want.Name || got.Manufacturer != test.want.Manufacturer || got.Price != test.want.Price ||
+				got.ListPrice != test.want.ListPrice || got.Stock != test.want.Stock || got.Discounted != test.want.Discounted {
+				t.Errorf("merged = %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	product := func(supplier, sku, barcode, part, description string) types.Product {
+		return types.Product{Supplier: supplier, SKU: sku, Barcode: barcode, PartNumber: part, Description: description, Price: "100"}
+	}
+	tests := []struct {
+		name  string
+		feeds [][]types.Product
+		// SKU and description of each merged product, in order
+		want       [][2]string
+		wantShared int
+		// SKUs left out for colliding
+		wantCollisions []string
+	}{
+		{"matched by barcode",
+			[][]types.Product{
+				{product("a", "A1", "600123", "", "from a")},
+				{product("b", "B1", "600123", "", "from b")},
+			},
+			[][2]string{{"A1", "from a"}}, 1, nil},
+		{"matched by part number, ignoring case",
+			[][]types.Product{
+				{product("a", "A1", "", "xk-10", "")},
+				{product("b", "B1", "", "XK-10", "from b")},
+			},
+			[][2]string{{"A1", "from b"}}, 1, nil},
+		{"unmatched offers stay apart",
+			[][]types.Product{
+				{product("a", "A1", "1", "", ""), product("a", "A2", "2", "", "")},
+				{product("b", "B1", "3", "", "")},
+			},
+			[][2]string{{"A1", ""}, {"A2", ""}, {"B1", ""}}, 0, nil},
+		{"one offer per supplier in a group",
+			[][]types.Product{
+				{product("a", "A1", "1", "", ""), product("a", "A2", "1", "", "")},
+			},
+			[][2]string{{"A1", ""}, {"A2", ""}}, 0, nil},
+		{"colliding SKU is skipped",
+			[][]types.Product{
+				{product("a", "X1", "1", "", "")},
+				{product("b", "X1", "2", "", "")},
+			},
+			[][2]string{{"X1", ""}}, 0, []string{"X1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			feeds := make([]iter.Seq2[types.Product, error], len(test.feeds))
+			offers := 0
+			for i, products := range test.feeds {
+				feeds[i] = feed(products...)
+				offers += len(products)
+			}
+			merger := NewMerger(MergeOptions{})
+			got := make([][2]string, 0)
+			for product, err := range merger.Merge(feeds) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, [2]string{product.SKU, product.Description})
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("merged %q, want %q", got, test.want)
+			}
+
+			report := merger.Report()
+			if report.Offers != offers || report.Suppliers != len(feeds) || report.Products != len(test.want) || report.Shared != test.wantShared {
+				t.Errorf("report = %+v", report)
+			}
+			collisions := make([]string, 0)
+			for _, collision := range report.Collisions {
+				collisions = append(collisions, collision.SKU)
+			}
+			if !slices.Equal(collisions, test.wantCollisions) {
+				t.Errorf("collisions %q, want %q", collisions, test.wantCollisions)
+			}
+		})
+	}
+}
+
+func TestMergeReadsOnce(t *testing.T) {
+	reads := 0
+	counted := func(yield func(types.Product, error) bool) {
+		reads++
+		yield(types.Product{Supplier: "a", SKU: "A1", Barcode: "1", Price: "100"}, nil)
+	}
+	merger := NewMerger(MergeOptions{})
+	products := merger.Merge([]iter.Seq2[types.Product, error]{counted, feed(types.Product{Supplier: "b", SKU: "B1", Barcode: "1", Price: "90"})})
+	for iteration := 1; iteration <= 2; iteration++ {
+		for _, err := range products {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reads != iteration {
+			t.Errorf("feed read %d times in %d iterations", reads, iteration)
+		}
+		if report := merger.Report(); report.Offers != 2 || report.Products != 1 {
+			t.Errorf("report after iteration %d = %+v", iteration, report)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package supplier
+
+import (
+	"fmt"
+	"iter"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/feedfile"
+	"github.com/RoundRobinHood/jouma-data-migration/tarsus"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+// A supplier feed. Products may be read more than once per sync; iteration
+// stops after the first error, and a feed that can't be read completely must
+// yield an error rather than end early. The exception is a *RowError, which
+// only rejects one product.
+type Source interface {
+	// Recorded as the Supplier of every product
+	Name() string
+	Products() iter.Seq2[types.Product, error]
+	// Bytes read by the last iteration, after decompression
+	BytesRead() int64
+}
+
+// Fields of a feed row that couldn't be parsed. A source yields it with the
+// rest of the product and carries on with the next row; the validator reports
+// each field as an error for that row.
+type RowError struct {
+	Invalid []InvalidField
+}
+
+type InvalidField struct {
+	Field string
+	Value string
+}
+
+func (e *RowError) Error() string {
+	messages := make([]string, len(e.Invalid))
+	for i, field := range e.Invalid {
+		messages[i] = fmt.Sprintf("invalid %s %q", field.Field, field.Value)
+	}
+	return strings.Join(messages, ", ")
+}
+
+// A Tarsus JSON feed file, optionally gzipped.
+type Tarsus struct {
+	Path string
+	read int64
+}
+
+func (t *Tarsus) Name() string {
+	return "tarsus"
+}
+
+func (t *Tarsus) BytesRead() int64 {
+	return t.read
+}
+
+func (t *Tarsus) Products() iter.Seq2[types.Product, error] {
+	return func(yield func(types.Product, error) bool) {
+		file, err := feedfile.Open(t.Path)
+		if err != nil {
+			yield(types.Product{}, fmt.Errorf("failed to open Tarsus feed: %w", err))
+			return
+		}
+		defer file.Close()
+
+		counter := &feedfile.CountingReader{Reader: file}
+		defer func() { t.read = counter.N }()
+		for product, err := range tarsus.Decode(counter) {
+			if !yield(product.Product(), err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package supplier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+type Severity string
+
+const (
+	// The product is left out of the sync
+	SeverityError Severity = "error"
+	// The product is synced as-is
+	SeverityWarning Severity = "warning"
+)
+
+type Issue struct {
+	Supplier string `json:"supplier"`
+	// 1-based position in the supplier's feed
+	Row      int      `json:"row"`
+	SKU      string   `json:"sku"`
+	Severity Severity `json:"severity"`
+	Field    string   `json:"field"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+}
+
+type ValidationReport struct {
+	Products int `json:"products"`
+	Valid    int `json:"valid"`
+	Excluded int `json:"excluded"`
+	Warnings int `json:"warnings"`
+	// SKUs of excluded products. Their WC products are skipped by the sync
+	// rather than deleted.
+	Skipped []string `json:"skipped"`
+	Issues  []Issue  `json:"issues"`
+}
+
+// Checks a supplier's products one at a time. Of several rows with the same SKU, the
+// first is kept and the rest are errors.
+type Validator struct {
+	report  ValidationReport
+	seen    map[string]int
+	skipped map[string]struct{}
+}
+
+func NewValidator() *Validator {
+	return &Validator{report: ValidationReport{Skipped: []string{}, Issues: []Issue{}}, seen: map[string]int{}, skipped: map[string]struct{}{}}
+}
+
+// Returns the issues found with product, which is at position row in the feed.
+func (v *Validator) Check(row int, product types.Product) []Issue {
+	return v.check(row, product, nil)
+}
+
+// Like Check, for a product whose row had fields that couldn't be parsed.
+func (v *Validator) check(row int, product types.Product, invalid []InvalidField) []Issue {
+	issues := make([]Issue, 0)
+	add := func(severity Severity, field, code, format string, args ...any) {
+		issues = append(issues, Issue{
+			Supplier: product.Supplier,
+			Row:      row,
+			SKU:      product.SKU,
+			Severity: severity,
+			Field:    field,
+			Code:     code,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, field := range invalid {
+		add(SeverityError, field.Field, "invalid_"+field.Field, "%s %q can't be read", field.Field, field.Value)
+	}
+
+	sku := strings.TrimSpace(product.SKU)
+	if sku == "" {
+		add(SeverityError, "sku", "empty_sku", "SKU is empty")
+	} else if first, ok := v.seen[sku]; ok {
+		add(SeverityError, "sku", "duplicate_sku", "SKU already used by row %d", first)
+	} else {
+		v.seen[sku] = row
+	}
+
+	if strings.TrimSpace(product.Name) == "" {
+		add(SeverityError, "name", "empty_name", "Product name is empty")
+	}
+	if product.Stock < 0 {
+		add(SeverityError, "stock", "negative_stock", "Stock is %d", product.Stock)
+	}
+
+	regular, ok := product.Price.Float()
+	switch {
+	case !ok:
+		add(SeverityError, "price", "invalid_price", "Price %q is not a number", product.Price)
+	case regular <= 0:
+		add(SeverityError, "price", "zero_price", "Price is %s", product.Price)
+	}
+	if real, ok := product.ListPrice.Float(); ok && real > 0 && regular > real {
+		add(SeverityWarning, "list_price", "price_above_list", "Price %s is above the list price %s", product.Price, product.ListPrice)
+	}
+
+	if product.ImageURL == "" {
+		add(SeverityWarning, "image_url", "missing_image", "No image URL")
+	} else if parsed, err := url.Parse(product.ImageURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		add(SeverityWarning, "image_url", "invalid_image_url", "Image URL %q is not a valid http(s) URL", product.ImageURL)
+	}
+	if strings.TrimSpace(product.Manufacturer) == "" {
+		add(SeverityWarning, "manufacturer", "empty_manufacturer", "Manufacturer is empty")
+	}
+	if strings.TrimSpace(product.Category) == "" {
+		add(SeverityWarning, "category", "empty_category", "Category is empty")
+	}
+
+	v.report.Products++
+	excluded := false
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			excluded = true
+		} else {
+			v.report.Warnings++
+		}
+	}
+	if excluded {
+		v.report.Excluded++
+		if _, ok := v.skipped[sku]; !ok && sku != "" {
+			v.skipped[sku] = struct{}{}
+			v.report.Skipped = append(v.report.Skipped, sku)
+		}
+	} else {
+		v.report.Valid++
+	}
+	v.report.Issues = append(v.report.Issues, issues...)
+	return issues
+}
+
+// Yields the products without errors. Rows rejected with a *RowError are
+// reported as issues; other errors are passed through. Each iteration starts
+// a fresh report, so the feed can be read again.
+func (v *Validator) Filter(products iter.Seq2[types.Product, error]) iter.Seq2[types.Product, error] {
+	return func(yield func(types.Product, error) bool) {
+		v.report = ValidationReport{Skipped: []string{}, Issues: []Issue{}}
+		v.seen = map[string]int{}
+		v.skipped = map[string]struct{}{}
+		row := 0
+		for product, err := range products {
+			var rowErr *RowError
+			if err != nil && !errors.As(err, &rowErr) {
+				yield(product, err)
+				return
+			}
+			row++
+			var invalid []InvalidField
+			if rowErr != nil {
+				invalid = rowErr.Invalid
+			}
+			valid := true
+			for _, issue := range v.check(row, product, invalid) {
+				valid = valid && issue.Severity != SeverityError
+			}
+			if valid && !yield(product, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (v *Validator) Report() ValidationReport {
+	return v.report
+}
+
+// Combines the reports of several suppliers' feeds.
+func CombineReports(reports ...ValidationReport) ValidationReport {
+	combined := ValidationReport{Skipped: []string{}, Issues: []Issue{}}
+	for _, report := range reports {
+		combined.Products += report.Products
+		combined.Valid += report.Valid
+		combined.Excluded += report.Excluded
+		combined.Warnings += report.Warnings
+		combined.Skipped = append(combined.Skipped, report.Skipped...)
+		combined.Issues = append(combined.Issues, report.Issues...)
+	}
+	return combined
+}
+
+func PrintValidationSummary(report ValidationReport) {
+	fmt.Printf("Validated %d products: %d valid, %d excluded, %d warnings\n", report.Products, report.Valid, report.Excluded, report.Warnings)
+	if len(report.Skipped) != 0 {
+		fmt.Printf("  %d excluded SKUs are skipped: their shop products are left as they are\n", len(report.Skipped))
+	}
+	counts := map[string]int{}
+	for _, issue := range report.Issues {
+		counts[string(issue.Severity)+" "+issue.Code]++
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s: %d\n", key, counts[key])
+	}
+}
+
+func WriteValidationReport(path string, report ValidationReport) error {
+	bytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(append(bytes, '\n'))
+		return err
+	}
+	return os.WriteFile(path, bytes, 0644)
+}
@@ -0,0 +1,181 @@
+package supplier
+
+import (
+	"errors"
+	"iter"
+	"slices"
+	"testing"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+func feed(products ...types.Product) iter.Seq2[types.Product, error] {
+	return func(yield func(types.Product, error) bool) {
+		for _, product := range products {
+			if !yield(product, nil) {
+				return
+			}
+		}
+	}
+}
+
+func validProduct(sku string) types.Product {
+	return types.Product{
+		Supplier:     "acme",
+		SKU:          sku,
+		Name:         "Cable " + sku,
+		Manufacturer: "Acme",
+		Category:     "Cables",
+		Price:        "100.00",
+		ListPrice:    "120.00",
+		Stock:        5,
+		ImageURL:     "https://img.test/" + sku + ".jpg",
+	}
+}
+
+func issueCodes(issues []Issue) []string {
+	codes := make([]string, len(issues))
+	for i, issue := range issues {
+		codes[i] = string(issue.Severity) + " " + issue.Code
+	}
+	return codes
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*types.Product)
+		want   []string
+	}{
+		{"valid", func(p *types.Product) {}, []string{}},
+		{"empty SKU", func(p *types.Product) { p.SKU = " " }, []string{"error empty_sku"}},
+		{"empty name", func(p *types.Product) { p.Name = "" }, []string{"error empty_name"}},
+		{"negative stock", func(p *types.Product) { p.Stock = -1 }, []string{"error negative_stock"}},
+		{"price not a number", func(p *types.Product) { p.Price = "R100" }, []string{"error invalid_price"}},
+		{"zero price", func(p *types.Product) { p.Price = "0" }, []string{"error zero_price"}},
+		{"price above list price", func(p *types.Product) { p.ListPrice = "90" }, []string{"warning price_above_list"}},
+		{"no list price", func(p *types.Product) { p.ListPrice = "" }, []string{}},
+		{"missing image", func(p *types.Product) { p.ImageURL = "" }, []string{"warning missing_image"}},
+		{"relative image URL", func(p *types.Product) { p.ImageURL = "/img/a.jpg" }, []string{"warning invalid_image_url"}},
+		{"ftp image URL", func(p *types.Product) { p.ImageURL = "ftp://img.test/a.jpg" }, []string{"warning invalid_image_url"}},
+		{"empty manufacturer and category", func(p *types.Product) { p.Manufacturer, p.Category = "", "" }, []string{"warning empty_manufacturer", "warning empty_category"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			product := validProduct("A1")
+			test.modify(&product)
+			if got := issueCodes(NewValidator().Check(1, product)); !slices.Equal(got, test.want) {
+				t.Errorf("issues = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	broken := validProduct("B1")
+	broken.Price = "0"
+	noImage := validProduct("C1")
+	noImage.ImageURL = ""
+
+	tests := []struct {
+		name        string
+		products    []types.Product
+		want        []string
+		wantSkipped []string
+		wantReport  [4]int // products, valid, excluded, warnings
+	}{
+		{"all valid", []types.Product{validProduct("A1"), validProduct("A2")}, []string{"A1", "A2"}, []string{}, [4]int{2, 2, 0, 0}},
+		{"errors are left out and skipped", []types.Product{validProduct("A1"), broken}, []string{"A1"}, []string{"B1"}, [4]int{2, 1, 1, 0}},
+		{"warnings are kept", []types.Product{noImage}, []string{"C1"}, []string{}, [4]int{1, 1, 0, 1}},
+		{"first of duplicate SKUs wins", []types.Product{validProduct("A1"), validProduct("A1")}, []string{"A1"}, []string{"A1"}, [4]int{2, 1, 1, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator := NewValidator()
+			got := []string{}
+			for product, err := range validator.Filter(feed(test.products...)) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, product.SKU)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("yielded %q, want %q", got, test.want)
+			}
+			report := validator.Report()
+			if !slices.Equal(report.Skipped, test.wantSkipped) {
+				t.Errorf("skipped %q, want %q", report.Skipped, test.wantSkipped)
+			}
+			if counts := [4]int{report.Products, report.Valid, report.Excluded, report.Warnings}; counts != test.wantReport {
+				t.Errorf("report counts %v, want %v", counts, test.wantReport)
+			}
+		})
+	}
+}
+
+func TestFilterRowErrors(t *testing.T) {
+	products := func(yield func(types.Product, error) bool) {
+		if !yield(validProduct("A1"), nil) {
+			return
+		}
+		if !yield(validProduct("B1"), &RowError{Invalid: []InvalidField{{Field: "stock", Value: "lots"}}}) {
+			return
+		}
+		yield(validProduct("C1"), nil)
+	}
+
+	validator := NewValidator()
+	got := []string{}
+	for product, err := range validator.Filter(products) {
+		if err != nil {
+			t.Fatalf("row error passed through: %v", err)
+		}
+		got = append(got, product.SKU)
+	}
+	if want := []string{"A1", "C1"}; !slices.Equal(got, want) {
+		t.Errorf("yielded %q, want %q", got, want)
+	}
+	report := validator.Report()
+	if codes := issueCodes(report.Issues); !slices.Equal(codes, []string{"error invalid_stock"}) {
+		t.Errorf("issues = %q", codes)
+	}
+	if report.Issues[0].Row != 2 {
+		t.Errorf("issue on row %d, want 2", report.Issues[0].Row)
+	}
+}
+
+func TestFilterPassesFeedErrors(t *testing.T) {
+	broken := errors.New("truncated feed")
+	products := func(yield func(types.Product, error) bool) {
+		if yield(validProduct("A1"), nil) {
+			yield(types.Product{}, broken)
+		}
+	}
+	var got error
+	for _, err := range NewValidator().Filter(products) {
+		got = err
+	}
+	if !errors.Is(got, broken) {
+		t.Errorf("error = %v, want %v", got, broken)
+	}
+}
+
+func TestFilterReadTwice(t *testing.T) {
+	validator := NewValidator()
+	products := validator.Filter(feed(validProduct("A1"), validProduct("A2")))
+	for range 2 {
+		count := 0
+		for _, err := range products {
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		if count != 2 {
+			t.Errorf("read %d products, want 2", count)
+		}
+	}
+	if report := validator.Report(); report.Products != 2 || report.Excluded != 0 {
+		t.Errorf("report after a second read = %+v", report)
+	}
+}
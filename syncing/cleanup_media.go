@@ -0,0 +1,101 @@
+package syncing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+	"github.com/RoundRobinHood/jouma-data-migration/wp"
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Finds image attachments the sync added (see wc.MarkMedia), uploaded by
+// author, that no WC product references. Attachments parented to something
+// other than a product are left alone, since they are likely used by a page or
+// post.
+//
+// With unmarked, attachments by author that aren't marked are considered
+// too, for images sideloaded before the sync marked them. Only use it when
+// author doesn't upload anything by hand.
+func FindOrphanedMedia(ctx context.Context, wp_cnf, wc_cnf types.ApiConfig, author int, unmarked bool) ([]types.WPMedia, error) {
+	ctx, cancel := guardStore(ctx)
+	defer cancel()
+
+	productIDs := map[int]struct{}{}
+	referenced := map[int]struct{}{}
+
+	fmt.Println("Reading products from WC site...")
+	products, errors := wc.GetAllProducts(ctx, wc_cnf, workerCount())
+
+	var fetchErr error
+	errEnd := make(chan struct{}, 0)
+	go func() {
+		defer close(errEnd)
+		for err := range errors {
+			fmt.Println(err)
+			fetchErr = err
+		}
+	}()
+
+	for product := range products {
+		productIDs[product.ID] = struct{}{}
+		for _, image := range product.Images {
+			referenced[image.Id] = struct{}{}
+		}
+	}
+	<-errEnd
+	if err := stopped(ctx, "reading products"); err != nil {
+		return nil, err
+	}
+
+	// An incomplete product list would make referenced images look orphaned
+	if fetchErr != nil {
+		return nil, fmt.Errorf("failed to read all products: %w", fetchErr)
+	}
+
+	fmt.Println("Reading media library...")
+	media, err := wp.GetAllMedia(ctx, wp_cnf, author)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media library: %w", err)
+	}
+
+	return orphanedMedia(media, productIDs, referenced, author, unmarked), nil
+}
+
+func orphanedMedia(media []types.WPMedia, productIDs, referenced map[int]struct{}, author int, unmarked bool) []types.WPMedia {
+	orphans := make([]types.WPMedia, 0)
+	for _, item := range media {
+		if !wc.IsMarkedMedia(item) && (!unmarked || author == 0 || item.Author != author) {
+			continue
+		}
+		if _, ok := referenced[item.ID]; ok {
+			continue
+		}
+		if _, ok := productIDs[item.Post]; item.Post != 0 && !ok {
+			continue
+		}
+		orphans = append(orphans, item)
+	}
+	return orphans
+}
+
+func DeleteMedia(ctx context.Context, wp_cnf types.ApiConfig, media []types.WPMedia) chan error {
+	errors := make(chan error, 0)
+	go func() {
+		defer close(errors)
+		bar := pb.StartNew(len(media))
+		defer bar.Finish()
+		for _, item := range media {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := wp.DeleteMedia(ctx, wp_cnf, item.ID); err != nil {
+				errors <- fmt.Errorf("failed to delete media %d: %w", item.ID, err)
+			}
+			bar.Increment()
+		}
+	}()
+
+	return errors
+}
@@ -0,0 +1,55 @@
+package syncing
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+)
+
+func TestOrphanedMedia(t *testing.T) {
+	const author = 7
+	attachment := func(id, by, post int, marked bool) types.WPMedia {
+		media := types.WPMedia{ID: id, Author: by, Post: post}
+		if marked {
+			media.Description.Rendered = "<p>" + wc.MediaMarker + "https://img.test/a.jpg</p>"
+		}
+		return media
+	}
+	media := []types.WPMedia{
+		attachment(1, author, 0, true),    // marked, unparented
+		attachment(2, author, 100, true),  // marked, parented to a product
+		attachment(3, author, 0, true),    // marked but referenced
+		attachment(4, author, 500, true),  // marked, parented to a page
+		attachment(5, author, 0, false),   // unmarked, by the author
+		attachment(6, author, 100, false), // unmarked, parented to a product
+		attachment(7, 9, 0, false),        // unmarked, by someone else
+		attachment(8, author, 0, false),   // unmarked but referenced
+		attachment(9, author, 500, false), // unmarked, parented to a page
+	}
+	productIDs := map[int]struct{}{100: {}}
+	referenced := map[int]struct{}{3: {}, 8: {}}
+
+	tests := []struct {
+		name     string
+		author   int
+		unmarked bool
+		want     []int
+	}{
+		{"marked only", author, false, []int{1, 2}},
+		{"with unmarked", author, true, []int{1, 2, 5, 6}},
+		{"unmarked needs an author", 0, true, []int{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make([]int, 0)
+			for _, orphan := range orphanedMedia(media, productIDs, referenced, test.author, test.unmarked) {
+				got = append(got, orphan.ID)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("orphans %v, want %v", got, test.want)
+			}
+		})
+	}
+}
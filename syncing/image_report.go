@@ -0,0 +1,75 @@
+package syncing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+)
+
+// When set, every feed image is checked and the problems are written to this
+// file as JSON. Otherwise only images of products being created are checked.
+var ImageReportPath = ""
+
+var ImageCheckWorkers = 8
+
+type ImageIssue struct {
+	SKU          string `json:"sku"`
+	Manufacturer string `json:"manufacturer"`
+	wc.ImageCheck
+	Placeholder int `json:"placeholder,omitempty"`
+}
+
+func BuildImageReport(ctx context.Context, products []types.Product) []ImageIssue {
+	sources := make([]string, 0, len(products))
+	for _, product := range products {
+		sources = append(sources, product.ImageURL)
+	}
+	wc.CheckImages(ctx, sources, ImageCheckWorkers)
+
+	issues := make([]ImageIssue, 0)
+	for _, product := range products {
+		check := wc.CheckImage(ctx, product.ImageURL)
+		if check.Status == wc.ImageOK {
+			continue
+		}
+		issues = append(issues, ImageIssue{
+			SKU:          product.SKU,
+			Manufacturer: product.Manufacturer,
+			ImageCheck:   check,
+			Placeholder:  wc.Placeholder(product.Manufacturer),
+		})
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].SKU < issues[j].SKU })
+	return issues
+}
+
+func PrintImageReportSummary(issues []ImageIssue) {
+	if len(issues) == 0 {
+		fmt.Println("No image problems found.")
+		return
+	}
+	counts := map[wc.ImageStatus]int{}
+	for _, issue := range issues {
+		counts[issue.Status]++
+	}
+	fmt.Printf("WARNING: %d products have no usable image:", len(issues))
+	for _, status := range []wc.ImageStatus{wc.ImageMissing, wc.ImageNotFound, wc.ImageBroken, wc.ImageTimeout, wc.ImageNotImage, wc.ImageTiny} {
+		if counts[status] != 0 {
+			fmt.Printf(" %s=%d", status, counts[status])
+		}
+	}
+	fmt.Println()
+}
+
+func WriteImageReport(path string, issues []ImageIssue) error {
+	bytes, err := json.MarshalIndent(issues, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, bytes, 0644)
+}
@@ -0,0 +1,164 @@
+package syncing
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+	"github.com/RoundRobinHood/jouma-data-migration/wp"
+)
+
+// Templates executed against a types.Product to fill in the text fields of
+// product images. A nil template leaves that field untouched.
+type MediaTemplates struct {
+	AltText *template.Template
+	Title   *template.Template
+	Caption *template.Template
+}
+
+var MediaText MediaTemplates
+
+// Media IDs whose text has already been set during this run
+var mediaTextDone = map[int]struct{}{}
+
+func (t MediaTemplates) Enabled() bool {
+	return t.AltText != nil || t.Title != nil || t.Caption != nil
+}
+
+func (t MediaTemplates) Render(product types.Product) (types.WPMediaUpdate, error) {
+	var update types.WPMediaUpdate
+	fields := []struct {
+		tmpl *template.Template
+		dst  *string
+	}{
+		{t.AltText, &update.AltText},
+		{t.Title, &update.Title},
+		{t.Caption, &update.Caption},
+	}
+	for _, field := range fields {
+		if field.tmpl == nil {
+			continue
+		}
+		var sb strings.Builder
+		if err := field.tmpl.Execute(&sb, product); err != nil {
+			return update, fmt.Errorf("failed to render %s template: %w", field.tmpl.Name(), err)
+		}
+		*field.dst = strings.TrimSpace(sb.String())
+	}
+	return update, nil
+}
+
+// Sets the configured alt text, title and caption on the featured image of a
+// WC product, once per media item per run.
+func ApplyMediaText(ctx context.Context, wp_cnf types.ApiConfig, product types.WooCommerceProduct, source types.Product) error {
+	if !MediaText.Enabled() || len(product.Images) == 0 || product.Images[0].Id == 0 {
+		return nil
+	}
+	id := product.Images[0].Id
+
+	if _, ok := mediaTextDone[id]; ok {
+		return nil
+	}
+	mediaTextDone[id] = struct{}{}
+
+	update, err := MediaText.Render(source)
+	if err != nil {
+		return err
+	}
+	if update == (types.WPMediaUpdate{}) {
+		return nil
+	}
+
+	if err := wp.UpdateMedia(ctx, wp_cnf, id, update); err != nil {
+		return fmt.Errorf("failed to set text on media %d (SKU: %q): %w", id, product.SKU, err)
+	}
+	return nil
+}
+
+// Reports whether an attachment's text differs from a rendered update. Empty
+// rendered fields are not compared, since they are never sent.
+func (t MediaTemplates) differs(media types.WPMedia, update types.WPMediaUpdate) bool {
+	return (t.AltText != nil && update.AltText != "" && media.AltText != update.AltText) ||
+		(t.Title != nil && update.Title != "" && media.Title.Raw != update.Title) ||
+		(t.Caption != nil && update.Caption != "" && media.Caption.Raw != update.Caption)
+}
+
+// Sets the media text on the featured images of existing products where it
+// differs from what the templates render, so template and feed changes reach
+// products created earlier. Placeholders and pinned images are left alone.
+// feed is read once more to render the templates.
+func SyncMediaText(ctx context.Context, wp_cnf types.ApiConfig, existing []types.WooCommerceProduct, feed iter.Seq2[types.Product, error]) error {
+	if !MediaText.Enabled() {
+		return nil
+	}
+
+	// The first product using each media ID sets its text
+	owners := map[int]types.WooCommerceProduct{}
+	ids := make([]int, 0)
+	for _, product := range existing {
+		if len(product.Images) == 0 || wc.ImagesPinned(product.SKU) {
+			continue
+		}
+		id := product.Images[0].Id
+		if id == 0 || wc.IsPlaceholder(id) {
+			continue
+		}
+		if _, ok := mediaTextDone[id]; ok {
+			continue
+		}
+		if _, ok := owners[id]; ok {
+			continue
+		}
+		owners[id] = product
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	fmt.Println("Checking image text on existing products...")
+	media, err := wp.GetMediaByID(ctx, wp_cnf, ids)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read product images, leaving their text alone: %v\n", err)
+		return stopped(ctx, "checking image text")
+	}
+	current := map[string]types.WPMedia{}
+	for _, item := range media {
+		current[owners[item.ID].SKU] = item
+	}
+
+	updated := 0
+	for source, err := range feed {
+		if err != nil {
+			return fmt.Errorf("failed to read the feed again: %w", err)
+		}
+		item, ok := current[source.SKU]
+		if !ok {
+			continue
+		}
+		if err := stopped(ctx, "updating image text"); err != nil {
+			return err
+		}
+		product := owners[item.ID]
+		update, err := MediaText.Render(source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render image text (SKU: %q): %v\n", product.SKU, err)
+			continue
+		}
+		if !MediaText.differs(item, update) {
+			continue
+		}
+		if err := ApplyMediaText(ctx, wp_cnf, product, source); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		updated++
+	}
+	fmt.Printf("Updated image text on %d products.\n", updated)
+	return nil
+}
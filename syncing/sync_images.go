@@ -0,0 +1,114 @@
+package syncing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+	"github.com/RoundRobinHood/jouma-data-migration/wp"
+	"github.com/cheggaaa/pb/v3"
+)
+
+// When set, a replaced featured image is deleted from the media library if
+// no other product uses it.
+var DeleteReplacedImages = false
+
+// Replaces the featured image of existing WC products whose feed image URL
+// (or, with wc.TrackImageHashes, image content) has changed. imageUsage counts
+// how many products reference each media ID. Products whose image is replaced
+// get their new images in existing, for SyncMediaText.
+func SyncImages(ctx context.Context, wp_cnf, wc_cnf types.ApiConfig, existing []types.WooCommerceProduct, lookup map[string]types.Product, imageUsage map[int]int) error {
+	fmt.Println("Checking existing products for image changes...")
+	bar := pb.StartNew(len(existing))
+	updated := 0
+	defer bar.Finish()
+	for i, product := range existing {
+		if err := stopped(ctx, "updating images"); err != nil {
+			return err
+		}
+		bar.Increment()
+		source := lookup[product.SKU].ImageURL
+		if source == "" || wc.ImagesPinned(product.SKU) {
+			continue
+		}
+
+		changed := wc.ImageChanged(product, source)
+		hash := ""
+		if !changed && wc.TrackImageHashes {
+			var err error
+			if hash, err = wc.ImageHash(ctx, source); err != nil {
+				fmt.Printf("Failed to hash image for product (SKU: %q): %v\n", product.SKU, err)
+				continue
+			}
+			stored := wc.GetMeta(product, wc.ImageHashMetaKey)
+			if stored == "" {
+				// Nothing to compare against yet, so only record the hash
+				_, err := wc.UpdateProduct(ctx, wc_cnf, types.WooCommerceProduct{
+					ID:       product.ID,
+					MetaData: wc.ImageMeta(source, hash),
+				})
+				if err != nil {
+					fmt.Printf("Failed to record image hash for product (SKU: %q): %v\n", product.SKU, err)
+				}
+				continue
+			}
+			changed = stored != hash
+		}
+		if !changed {
+			continue
+		}
+
+		// A changed file behind the same URL must not be matched to the old
+		// media item by name
+		reuse := hash == ""
+		image, ok, err := wc.ResolveImage(ctx, wp_cnf, source, reuse)
+		if err != nil {
+			fmt.Printf("Failed to resolve new image for product (SKU: %q): %v\n", product.SKU, err)
+			continue
+		}
+		if !ok {
+			fmt.Printf("WARNING: New image for product (SKU: %q) is unreachable. Keeping the old one.\n", product.SKU)
+			continue
+		}
+
+		if hash == "" && wc.TrackImageHashes {
+			if hash, err = wc.ImageHash(ctx, source); err != nil {
+				fmt.Printf("Failed to hash image for product (SKU: %q): %v\n", product.SKU, err)
+			}
+		}
+
+		images := []types.WCImage{image}
+		for _, gallery := range product.Images[min(1, len(product.Images)):] {
+			images = append(images, types.WCImage{Id: gallery.Id})
+		}
+		result, err := wc.UpdateProduct(ctx, wc_cnf, types.WooCommerceProduct{ID: product.ID, Images: images, MetaData: wc.ImageMeta(source, hash)})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update image for product (SKU: %q): %v\n", product.SKU, err)
+			metrics.Products.Inc("failed")
+			continue
+		}
+		updated++
+		metrics.Products.Inc("updated")
+		existing[i].Images = result.Images
+		if err := wc.MarkMedia(ctx, wp_cnf, result, source); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		if !DeleteReplacedImages || len(product.Images) == 0 {
+			continue
+		}
+		oldID := product.Images[0].Id
+		if oldID == 0 || wc.IsPlaceholder(oldID) || imageUsage[oldID] > 1 || (len(result.Images) != 0 && result.Images[0].Id == oldID) {
+			continue
+		}
+		if err := wp.DeleteMedia(ctx, wp_cnf, oldID); err != nil {
+			fmt.Printf("Failed to delete replaced image %d (SKU: %q): %v\n", oldID, product.SKU, err)
+		}
+		delete(imageUsage, oldID)
+	}
+	fmt.Printf("Updated images on %d products.\n", updated)
+	return nil
+}
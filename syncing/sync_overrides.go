@@ -0,0 +1,39 @@
+package syncing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+)
+
+// Restores the fields pinned by wc.Overrides on existing WC products where
+// the shop no longer has the pinned values.
+func SyncOverrides(ctx context.Context, wc_cnf types.ApiConfig, existing []types.WooCommerceProduct) error {
+	if len(wc.Overrides) == 0 {
+		return nil
+	}
+	fmt.Println("Checking existing products for pinned fields...")
+	updated := 0
+	for _, product := range existing {
+		if err := stopped(ctx, "restoring pinned fields"); err != nil {
+			return err
+		}
+		update, ok := wc.OverrideUpdate(product)
+		if !ok {
+			continue
+		}
+		if _, err := wc.UpdateProduct(ctx, wc_cnf, update); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restore pinned fields for product (SKU: %q): %v\n", product.SKU, err)
+			metrics.Products.Inc("failed")
+			continue
+		}
+		updated++
+		metrics.Products.Inc("updated")
+	}
+	fmt.Printf("Restored pinned fields on %d products.\n", updated)
+	return nil
+}
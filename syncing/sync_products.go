@@ -1,31 +1,104 @@
 package syncing
 
 import (
+	"context"
 	"fmt"
+	"iter"
 	"os"
-	"time"
+	"strings"
 
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
 	"github.com/RoundRobinHood/jouma-data-migration/wc"
 	"github.com/cheggaaa/pb/v3"
 )
 
-func SyncProducts(wp_cnf, wc_cnf types.ApiConfig, TarsusProducts []types.TarsusProduct) {
-	// Used to quickly check SKUs against tarsus products
-	lookup := map[string]types.TarsusProduct{}
+// What happens to WC products that left the feed or were filtered out of it
+type RemovalPolicy string
+
+const (
+	RemoveDelete RemovalPolicy = "delete"
+	// Moved to draft, and published again if they return to the feed
+	RemoveDraft RemovalPolicy = "draft"
+	RemoveLeave RemovalPolicy = "leave"
+)
+
+var Removal = RemoveDelete
+
+func ParseRemovalPolicy(s string) (RemovalPolicy, error) {
+	switch policy := RemovalPolicy(strings.ToLower(strings.TrimSpace(s))); policy {
+	case RemoveDelete, RemoveDraft, RemoveLeave:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown delete policy %q: expected 'delete', 'draft' or 'leave'", s)
+}
+
+// The fields of a feed product that are compared against WC products. The
+// rest are read from the feed again for the products that get created.
+func diffFields(product types.Product) types.Product {
+	return types.Product{
+		Supplier:     product.Supplier,
+		SKU:          product.SKU,
+		SupplierSKU:  product.SupplierSKU,
+		Manufacturer: product.Manufacturer,
+		Stock:        product.Stock,
+		Price:        product.Price,
+		ImageURL:     product.ImageURL,
+	}
+}
+
+// Adds one use of each media ID the product shows.
+func countImages(usage map[int]int, product types.WooCommerceProduct) {
+	seen := map[int]struct{}{}
+	for _, image := range product.Images {
+		if _, ok := seen[image.Id]; !ok && image.Id != 0 {
+			seen[image.Id] = struct{}{}
+			usage[image.Id]++
+		}
+	}
+}
+
+// Returns the context's error if the sync was cancelled part-way, or
+// rest.ErrCircuitOpen if the store became unavailable. The whole feed is read
+// before anything is changed, so a broken feed can't cause deletions.
+//
+// Only the fields compared against WC products are kept in memory, so feed is
+// read again for the products to create (and for image text). Every range over
+// feed must read it from the start.
+//
+// WC products missing from the feed are removed as Removal says, unless
+// skipped reports their SKU, which is asked once the feed has been read. These are left as they are,
+// for products left out of the feed because their rows were invalid.
+func SyncProducts(ctx context.Context, wp_cnf, wc_cnf types.ApiConfig, feed iter.Seq2[types.Product, error], skipped func(sku string) bool) error {
+	// Used to quickly check SKUs against feed products
+	lookup := map[string]types.Product{}
 
 	// Delete a key when you find it (leftovers have to be created on WC)
 	createCache := map[string]struct{}{}
 
-	// List of IDs to be deleted
+	// List of IDs to be deleted (or drafted, see Removal)
 	deleteList := make([]int, 0)
 
-	for _, product := range TarsusProducts {
-		lookup[product.ProductNumber] = product
-		createCache[product.ProductNumber] = struct{}{}
+	// Products drafted by the sync that are back in the feed
+	publishList := make([]int, 0)
+
+	// Products that stay on WC, checked for image changes
+	existing := make([]types.WooCommerceProduct, 0)
+
+	// Number of products left on the store using each media ID, whether they
+	// are synced, skipped, drafted or left alone
+	imageUsage := map[int]int{}
+
+	for product, err := range feed {
+		if err != nil {
+			return err
+		}
+		lookup[product.SKU] = diffFields(product)
+		createCache[product.SKU] = struct{}{}
 	}
 
-	products, errors := wc.GetAllProducts(wc_cnf, 10)
+	phaseDone := metrics.Phase("read")
+	products, errors := wc.GetAllProducts(ctx, wc_cnf, workerCount())
 
 	errEnd := make(chan struct{}, 0)
 	go func() {
@@ -36,74 +109,206 @@ func SyncProducts(wp_cnf, wc_cnf types.ApiConfig, TarsusProducts []types.TarsusP
 	}()
 
 	fmt.Println("Reading products from WC site...")
+	skips := 0
 	for product := range products {
 		delete(createCache, product.SKU)
 		if _, ok := lookup[product.SKU]; !ok {
-			deleteList = append(deleteList, product.ID)
+			switch {
+			case skipped != nil && skipped(product.SKU):
+				skips++
+			case Removal == RemoveDraft && product.Status == "draft":
+				// Already hidden
+			default:
+				deleteList = append(deleteList, product.ID)
+				if Removal == RemoveDelete {
+					continue
+				}
+			}
+			// Still on the store, showing its images
+			countImages(imageUsage, product)
+			continue
+		}
+		if wc.GetMeta(product, wc.DraftedMetaKey) == "1" {
+			publishList = append(publishList, product.ID)
 		}
+		existing = append(existing, product)
+		countImages(imageUsage, product)
 	}
 
 	<-errEnd
+	phaseDone()
 
-	if len(deleteList) == 0 {
+	// A partial product list would lead to duplicate creations
+	if err := stopped(ctx, "reading products"); err != nil {
+		return err
+	}
+	if skips != 0 {
+		fmt.Printf("Skipped %d products whose feed rows failed validation. They are left as they are.\n", skips)
+		metrics.Products.Add(float64(skips), "skipped")
+	}
+
+	switch {
+	case len(deleteList) == 0:
 		fmt.Println("No products to delete on WP site.")
-	} else {
-		fmt.Println("Deleting products that weren't on Tarsus...")
-		errors = wc.DeleteProducts(wc_cnf, deleteList, 3, 40)
+	case Removal == RemoveLeave:
+		fmt.Printf("Leaving %d products that weren't in the feed or were filtered out (delete policy %q).\n", len(deleteList), Removal)
+	default:
+		phaseDone = metrics.Phase("delete")
+		if Removal == RemoveDraft {
+			fmt.Println("Moving products that weren't in the feed or were filtered out to draft...")
+			errors = wc.SetProductStatus(ctx, wc_cnf, deleteList, "draft", workerCount(), 40)
+		} else {
+			fmt.Println("Deleting products that weren't in the feed or were filtered out...")
+			errors = wc.DeleteProducts(ctx, wc_cnf, deleteList, workerCount(), 40)
+		}
 		for err := range errors {
 			fmt.Println(err)
 		}
+		phaseDone()
+	}
+	if len(publishList) != 0 && ctx.Err() == nil {
+		fmt.Println("Publishing drafted products that are back in the feed...")
+		for err := range wc.SetProductStatus(ctx, wc_cnf, publishList, "publish", workerCount(), 40) {
+			fmt.Println(err)
+		}
 	}
 
+	if err := stopped(ctx, "deleting products"); err != nil {
+		return err
+	}
+
+	phaseDone = metrics.Phase("images")
+	if err := SyncImages(ctx, wp_cnf, wc_cnf, existing, lookup, imageUsage); err != nil {
+		return err
+	}
+	if err := SyncMediaText(ctx, wp_cnf, existing, feed); err != nil {
+		return err
+	}
+	phaseDone()
+
+	phaseDone = metrics.Phase("suppliers")
+	if err := SyncSuppliers(ctx, wc_cnf, existing, lookup); err != nil {
+		return err
+	}
+	phaseDone()
+
+	phaseDone = metrics.Phase("overrides")
+	if err := SyncOverrides(ctx, wc_cnf, existing); err != nil {
+		return err
+	}
+	phaseDone()
+
 	SKUs := make([]string, 0, len(createCache))
 	for sku := range createCache {
 		SKUs = append(SKUs, sku)
 	}
 	fmt.Println("SKUs to be created:", SKUs)
 
-	fmt.Println("Validating & converting Tarsus products to WooCommerce products...")
+	fmt.Println("Checking product images...")
+	reportProducts := make([]types.Product, 0, len(createCache))
+	if ImageReportPath == "" {
+		for sku := range createCache {
+			reportProducts = append(reportProducts, lookup[sku])
+		}
+	} else {
+		for _, product := range lookup {
+			reportProducts = append(reportProducts, product)
+		}
+	}
+	phaseDone = metrics.Phase("image_report")
+	imageIssues := BuildImageReport(ctx, reportProducts)
+	phaseDone()
+	if err := stopped(ctx, "checking product images"); err != nil {
+		return err
+	}
+	PrintImageReportSummary(imageIssues)
+	if ImageReportPath != "" {
+		if err := WriteImageReport(ImageReportPath, imageIssues); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to write image report to %q: %v\n", ImageReportPath, err)
+		} else {
+			fmt.Printf("Image report written to %q\n", ImageReportPath)
+		}
+	}
+
+	fmt.Println("Converting feed products to WooCommerce products...")
+	phaseDone = metrics.Phase("convert")
 	bar := pb.StartNew(len(createCache))
 	createProducts := make([]types.WooCommerceProduct, 0, len(createCache))
-	for sku := range createCache {
-		exists, err := wc.SKUExists(wc_cnf, sku)
+	// Feed products being created, for their image text
+	sources := map[string]types.Product{}
+	for product, err := range feed {
+		if err != nil {
+			bar.Finish()
+			return fmt.Errorf("failed to read the feed again: %w", err)
+		}
+		sku := product.SKU
+		if _, ok := createCache[sku]; !ok {
+			continue
+		}
+		if err := stopped(ctx, "converting products"); err != nil {
+			bar.Finish()
+			return err
+		}
+		exists, err := wc.SKUExists(ctx, wc_cnf, sku)
 		if err != nil {
 			fmt.Printf("Failed to check if product already exists (skipping product, SKU %q): \n%v\n", sku, err)
-			time.Sleep(time.Second)
+			metrics.Products.Inc("failed")
 			bar.Increment()
 			continue
 		}
 		if exists {
 			fmt.Println("Product SKU already exists on WP site. Skipping")
-			time.Sleep(time.Second)
 			bar.Increment()
 			continue
 		}
 
-		tarsusProduct := lookup[sku]
-		time.Sleep(time.Second)
-		wcProduct, err := wc.FromTarsusProduct(tarsusProduct, wp_cnf)
+		wcProduct, err := wc.FromProduct(ctx, product, wp_cnf)
 		if err != nil {
-			fmt.Printf("Failed to convert Tarsus Product (SKU: %q): %v\n", sku, err)
+			fmt.Printf("Failed to convert product (SKU: %q): %v\n", sku, err)
+			metrics.Products.Inc("failed")
 		} else {
-			createProducts = append(createProducts, wcProduct)
-		}
-		if len(wcProduct.Images) == 0 {
-			fmt.Printf("WARNING: Product (SKU: %q) had an invalid image and is scheduled to be created with no images.\n", sku)
+			createProducts = append(createProducts, wc.ApplyOverride(wcProduct))
+			if MediaText.Enabled() {
+				sources[sku] = product
+			}
 		}
 		bar.Increment()
-		time.Sleep(time.Second)
 	}
 	bar.Finish()
+	phaseDone()
 
-	time.Sleep(time.Second)
+	if err := stopped(ctx, "converting products"); err != nil {
+		return err
+	}
 
 	if len(createProducts) == 0 {
 		fmt.Println("No product creation required.")
 	} else {
 		fmt.Println("Creating products that weren't on the WP site...")
-		errors = wc.CreateProducts(wp_cnf, wc_cnf, createProducts, 1)
-		for err := range errors {
-			fmt.Fprintln(os.Stderr, err)
+		phaseDone = metrics.Phase("create")
+		created, errors := wc.CreateProducts(ctx, wp_cnf, wc_cnf, createProducts, workerCount())
+
+		errEnd := make(chan struct{}, 0)
+		go func() {
+			defer close(errEnd)
+			for err := range errors {
+				fmt.Fprintln(os.Stderr, err)
+				metrics.Products.Inc("failed")
+			}
+		}()
+
+		for product := range created {
+			metrics.Products.Inc("created")
+			if err := ApplyMediaText(ctx, wp_cnf, product, sources[product.SKU]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if err := wc.MarkMedia(ctx, wp_cnf, product, lookup[product.SKU].ImageURL); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
 		}
+		<-errEnd
+		phaseDone()
 	}
+
+	return stopped(ctx, "creating products")
 }
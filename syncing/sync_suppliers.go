@@ -0,0 +1,39 @@
+package syncing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wc"
+)
+
+// Records the winning supplier on existing WC products where it changed,
+// along with the price and stock of its offer, when wc.TrackSuppliers is set.
+func SyncSuppliers(ctx context.Context, wc_cnf types.ApiConfig, existing []types.WooCommerceProduct, lookup map[string]types.Product) error {
+	if !wc.TrackSuppliers {
+		return nil
+	}
+	fmt.Println("Checking existing products for supplier changes...")
+	updated := 0
+	for _, product := range existing {
+		if err := stopped(ctx, "updating suppliers"); err != nil {
+			return err
+		}
+		source, ok := lookup[product.SKU]
+		if !ok || !wc.SupplierChanged(product, source) {
+			continue
+		}
+		if err := wc.UpdateSupplier(ctx, wc_cnf, product.ID, source); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record supplier for product (SKU: %q): %v\n", product.SKU, err)
+			metrics.Products.Inc("failed")
+			continue
+		}
+		updated++
+		metrics.Products.Inc("updated")
+	}
+	fmt.Printf("Recorded a new supplier, price and stock on %d products.\n", updated)
+	return nil
+}
@@ -1,9 +1,50 @@
 package syncing
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+
+	"github.com/RoundRobinHood/jouma-data-migration/rest"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
 )
 
-func SyncUp(wp_cnf, wc_cnf types.ApiConfig, TarsusProducts []types.TarsusProduct) {
-	SyncProducts(wp_cnf, wc_cnf, TarsusProducts)
+// Workers started per phase. How many of their requests are actually in
+// flight is decided by rest.SiteConcurrency as the site's health changes.
+func workerCount() int {
+	return rest.SiteConcurrency.Max
+}
+
+// Cancels the returned context with rest.ErrCircuitOpen when the site's
+// circuit breaker opens, so the running phase winds down the same way it
+// does on an interrupt.
+func guardStore(ctx context.Context) (context.Context, context.CancelFunc) {
+	guarded, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-guarded.Done():
+		case <-rest.SiteBreaker.Opened():
+			cancel(rest.ErrCircuitOpen)
+		}
+	}()
+	return guarded, func() { cancel(nil) }
+}
+
+// Why ctx was cancelled, naming the phase if the store became unavailable.
+func stopped(ctx context.Context, phase string) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	cause := context.Cause(ctx)
+	if errors.Is(cause, rest.ErrCircuitOpen) {
+		return fmt.Errorf("%s: %w", phase, cause)
+	}
+	return cause
+}
+
+func SyncUp(ctx context.Context, wp_cnf, wc_cnf types.ApiConfig, products iter.Seq2[types.Product, error], skipped func(sku string) bool) error {
+	ctx, cancel := guardStore(ctx)
+	defer cancel()
+	return SyncProducts(ctx, wp_cnf, wc_cnf, products, skipped)
 }
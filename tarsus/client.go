@@ -0,0 +1,235 @@
+// Package tarsus downloads the Tarsus product feed, keeping compressed
+// snapshots of it and remembering which version was last synced.
+package tarsus
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/RoundRobinHood/jouma-data-migration/feedfile"
+	"github.com/RoundRobinHood/jouma-data-migration/rest"
+)
+
+var tarsus_client = rest.RestClient{
+	Client: rest.NewClient(0),
+	Retry:  rest.DefaultRetryPolicy(),
+}
+
+type Client struct {
+	URL   string
+	Token string
+	// Where snapshots and the fetch state are kept
+	SnapshotDir string
+	// Snapshots beyond this many are deleted, oldest first. Zero keeps all.
+	KeepSnapshots int
+}
+
+type Feed struct {
+	// SHA-256 of the uncompressed feed
+	Hash string
+	// Gzipped snapshot file holding the feed
+	Snapshot string
+	// The server answered 304, so Snapshot is the last snapshot
+	NotModified bool
+	// The feed is the same as the feed of the last successful sync
+	Unchanged bool
+}
+
+type state struct {
+	ETag           string    `json:"etag,omitempty"`
+	LastModified   string    `json:"last_modified,omitempty"`
+	LatestSnapshot string    `json:"latest_snapshot,omitempty"`
+	LatestHash     string    `json:"latest_hash,omitempty"`
+	SyncedHash     string    `json:"synced_hash,omitempty"`
+	SyncedAt       time.Time `json:"synced_at,omitempty"`
+}
+
+const snapshotPrefix = "tarsus-"
+const snapshotSuffix = ".json.gz"
+
+func (c *Client) statePath() string {
+	return filepath.Join(c.SnapshotDir, "state.json")
+}
+
+func (c *Client) loadState() (state, error) {
+	var s state
+	bytes, err := os.ReadFile(c.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return s, fmt.Errorf("invalid feed state %q: %w", c.statePath(), err)
+	}
+	return s, nil
+}
+
+func (c *Client) saveState(s state) error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.statePath(), bytes, 0644)
+}
+
+// SHA-256 of a feed file, decompressed
+func hashFile(path string) (string, error) {
+	file, err := feedfile.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Downloads the feed, asking the server to skip the body if it hasn't changed
+// since the last download. The body is streamed into a snapshot file, so the
+// feed is never held in memory.
+func (c *Client) Fetch(ctx context.Context) (Feed, error) {
+	var feed Feed
+	if err := os.MkdirAll(c.SnapshotDir, 0755); err != nil {
+		return feed, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	s, err := c.loadState()
+	if err != nil {
+		return feed, err
+	}
+
+	headers := map[string]string{}
+	if _, err := os.Stat(s.LatestSnapshot); s.LatestSnapshot != "" && err == nil {
+		if s.ETag != "" {
+			headers["If-None-Match"] = s.ETag
+		}
+		if s.LastModified != "" {
+			headers["If-Modified-Since"] = s.LastModified
+		}
+	}
+
+	download := filepath.Join(c.SnapshotDir, "download"+snapshotSuffix)
+	defer os.Remove(download)
+	resp, err := tarsus_client.Request(ctx, c.URL, &rest.RequestOptions{
+		Method:  "GET",
+		Headers: headers,
+		Auth:    rest.BearerAuth{Token: c.Token},
+		Download: func(body io.Reader) (err error) {
+			feed.Hash, err = writeSnapshot(download, body)
+			return err
+		},
+	}, nil)
+	switch {
+	case rest.ErrorStatus(err) == 304:
+		if feed.Hash, err = hashFile(s.LatestSnapshot); err != nil {
+			return feed, fmt.Errorf("feed not modified, but failed to read the last snapshot: %w", err)
+		}
+		feed.NotModified = true
+		feed.Snapshot = s.LatestSnapshot
+	case err != nil:
+		return feed, err
+	default:
+		feed.Snapshot = s.LatestSnapshot
+		if feed.Hash != s.LatestHash || s.LatestSnapshot == "" {
+			feed.Snapshot = filepath.Join(c.SnapshotDir, snapshotPrefix+time.Now().UTC().Format("20060102T150405Z")+snapshotSuffix)
+			if err := os.Rename(download, feed.Snapshot); err != nil {
+				return feed, fmt.Errorf("failed to write feed snapshot: %w", err)
+			}
+			if err := c.rotate(); err != nil {
+				fmt.Fprintln(os.Stderr, "WARNING: Failed to delete old feed snapshots:", err)
+			}
+		}
+		s.ETag = resp.Header.Get("ETag")
+		s.LastModified = resp.Header.Get("Last-Modified")
+		s.LatestSnapshot = feed.Snapshot
+		s.LatestHash = feed.Hash
+	}
+
+	feed.Unchanged = s.SyncedHash != "" && s.SyncedHash == feed.Hash
+	if err := c.saveState(s); err != nil {
+		return feed, fmt.Errorf("failed to save feed state: %w", err)
+	}
+	return feed, nil
+}
+
+// Records feed as synced, so the next Fetch can tell if anything changed.
+func (c *Client) MarkSynced(feed Feed) error {
+	s, err := c.loadState()
+	if err != nil {
+		return err
+	}
+	s.SyncedHash = feed.Hash
+	s.SyncedAt = time.Now()
+	return c.saveState(s)
+}
+
+// Gzips data into path, replacing what was there, and returns the SHA-256
+// of data.
+func writeSnapshot(path string, data io.Reader) (string, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	writer := gzip.NewWriter(file)
+	if _, err := io.Copy(io.MultiWriter(writer, hasher), data); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), file.Close()
+}
+
+// Deletes the oldest snapshots beyond KeepSnapshots.
+func (c *Client) rotate() error {
+	if c.KeepSnapshots <= 0 {
+		return nil
+	}
+	snapshots, err := filepath.Glob(filepath.Join(c.SnapshotDir, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		return err
+	}
+	// Timestamps in the names sort chronologically
+	sort.Strings(snapshots)
+	for _, path := range snapshots[:max(0, len(snapshots)-c.KeepSnapshots)] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the decompressed feed in snapshot to path.
+func Extract(snapshot, path string) error {
+	file, err := feedfile.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, file); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,82 @@
+package tarsus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+// Yields the products of a feed one at a time, without holding the whole
+// feed in memory. Iteration stops after the first error, and an error is
+// yielded if the feed ends early or has no products array, so a truncated
+// feed can't be mistaken for a short one.
+func Decode(r io.Reader) iter.Seq2[types.TarsusProduct, error] {
+	return func(yield func(types.TarsusProduct, error) bool) {
+		dec := json.NewDecoder(r)
+		fail := func(err error) {
+			yield(types.TarsusProduct{}, fmt.Errorf("invalid Tarsus feed: %w", err))
+		}
+
+		if err := expectDelim(dec, '{'); err != nil {
+			fail(err)
+			return
+		}
+		found := false
+		for dec.More() {
+			token, err := dec.Token()
+			if err != nil {
+				fail(err)
+				return
+			}
+			if key, _ := token.(string); key != "products" {
+				var skip json.RawMessage
+				if err := dec.Decode(&skip); err != nil {
+					fail(err)
+					return
+				}
+				continue
+			}
+
+			found = true
+			if err := expectDelim(dec, '['); err != nil {
+				fail(err)
+				return
+			}
+			for dec.More() {
+				var product types.TarsusProduct
+				if err := dec.Decode(&product); err != nil {
+					fail(err)
+					return
+				}
+				if !yield(product, nil) {
+					return
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				fail(err)
+				return
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			fail(err)
+			return
+		}
+		if !found {
+			fail(fmt.Errorf("no products array"))
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %q, got %v", delim, token)
+	}
+	return nil
+}
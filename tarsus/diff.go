@@ -0,0 +1,208 @@
+package tarsus
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"sort"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+	// Relative change for prices
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+type ProductSummary struct {
+	SKU   string `json:"sku"`
+	Name  string `json:"name"`
+	Price string `json:"price"`
+	Stock int    `json:"stock"`
+}
+
+type ProductChange struct {
+	SKU     string        `json:"sku"`
+	Name    string        `json:"name"`
+	Changes []FieldChange `json:"changes"`
+}
+
+type FeedDiff struct {
+	Added   []ProductSummary `json:"added"`
+	Removed []ProductSummary `json:"removed"`
+	Changed []ProductChange  `json:"changed"`
+}
+
+func summarize(product types.TarsusProduct) ProductSummary {
+	return ProductSummary{SKU: product.ProductNumber, Name: product.ShortDesc, Price: string(product.PriceExVAT), Stock: product.Stock}
+}
+
+func formatTime(t types.ZonelessTimestamp) string {
+	if t.Time == nil {
+		return ""
+	}
+	return t.Time.Format("2006-01-02")
+}
+
+func priceChange(field string, from, to types.PriceString) (FieldChange, bool) {
+	oldValue, oldOK := from.Float()
+	newValue, newOK := to.Float()
+	if oldOK && newOK && oldValue == newValue {
+		return FieldChange{}, false
+	}
+	if !oldOK && !newOK && from == to {
+		return FieldChange{}, false
+	}
+	change := FieldChange{Field: field, Old: string(from), New: string(to)}
+	if oldOK && newOK && oldValue != 0 {
+		percent := (newValue - oldValue) / oldValue * 100
+		change.Percent = &percent
+	}
+	return change, true
+}
+
+// Field-level differences between two versions of a product.
+func CompareProducts(from, to types.TarsusProduct) []FieldChange {
+	changes := make([]FieldChange, 0)
+	if change, ok := priceChange("Price_ex_Vat", from.PriceExVAT, to.PriceExVAT); ok {
+		changes = append(changes, change)
+	}
+	if change, ok := priceChange("Non_Discount_Price_ex_Vat", from.RealPriceExVat, to.RealPriceExVat); ok {
+		changes = append(changes, change)
+	}
+
+	fields := []struct {
+		name     string
+		old, new string
+	}{
+		{"Available_Stock", fmt.Sprint(from.Stock), fmt.Sprint(to.Stock)},
+		{"ETA_Date", formatTime(from.ETADate), formatTime(to.ETADate)},
+		{"Product_Discounted", fmt.Sprint(bool(from.Discounted)), fmt.Sprint(bool(to.Discounted))},
+		{"Short_Advertising_Description", from.ShortDesc, to.ShortDesc},
+		{"Product_Description", from.Description, to.Description},
+		{"Manufacturer", from.Manufacturer, to.Manufacturer},
+		{"Category", from.Category, to.Category},
+		{"Image_URL", from.ImageURL, to.ImageURL},
+	}
+	for _, field := range fields {
+		if field.old != field.new {
+			changes = append(changes, FieldChange{Field: field.name, Old: field.old, New: field.new})
+		}
+	}
+	return changes
+}
+
+// Compares two feeds. Only the old feed is held in memory; the new one is
+// streamed.
+func Diff(oldFeed, newFeed iter.Seq2[types.TarsusProduct, error]) (FeedDiff, error) {
+	diff := FeedDiff{Added: []ProductSummary{}, Removed: []ProductSummary{}, Changed: []ProductChange{}}
+
+	previous := map[string]types.TarsusProduct{}
+	for product, err := range oldFeed {
+		if err != nil {
+			return diff, fmt.Errorf("old feed: %w", err)
+		}
+		// Like the validator, keep the first of duplicate SKUs
+		if _, ok := previous[product.ProductNumber]; !ok {
+			previous[product.ProductNumber] = product
+		}
+	}
+
+	seen := map[string]struct{}{}
+	for product, err := range newFeed {
+		if err != nil {
+			return diff, fmt.Errorf("new feed: %w", err)
+		}
+		if _, ok := seen[product.ProductNumber]; ok {
+			continue
+		}
+		seen[product.ProductNumber] = struct{}{}
+		before, ok := previous[product.ProductNumber]
+		if !ok {
+			diff.Added = append(diff.Added, summarize(product))
+			continue
+		}
+		if changes := CompareProducts(before, product); len(changes) != 0 {
+			diff.Changed = append(diff.Changed, ProductChange{SKU: product.ProductNumber, Name: product.ShortDesc, Changes: changes})
+		}
+	}
+	for sku, product := range previous {
+		if _, ok := seen[sku]; !ok {
+			diff.Removed = append(diff.Removed, summarize(product))
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].SKU < diff.Added[j].SKU })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].SKU < diff.Removed[j].SKU })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].SKU < diff.Changed[j].SKU })
+	return diff, nil
+}
+
+// Collapses whitespace and cuts s to n characters, never splitting a
+// multi-byte character.
+func shorten(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+	return s
+}
+
+func (c FieldChange) String() string {
+	text := fmt.Sprintf("%s: %q -> %q", c.Field, shorten(c.Old, 60), shorten(c.New, 60))
+	if c.Percent != nil {
+		text += fmt.Sprintf(" (%+.1f%%)", *c.Percent)
+	}
+	return text
+}
+
+func (d FeedDiff) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+	for _, product := range d.Added {
+		fmt.Fprintf(w, "+ %s\t%s\t(price %s, stock %d)\n", product.SKU, product.Name, product.Price, product.Stock)
+	}
+	for _, product := range d.Removed {
+		fmt.Fprintf(w, "- %s\t%s\n", product.SKU, product.Name)
+	}
+	for _, product := range d.Changed {
+		fmt.Fprintf(w, "~ %s\t%s\n", product.SKU, product.Name)
+		for _, change := range product.Changes {
+			fmt.Fprintf(w, "    %s\n", change)
+		}
+	}
+}
+
+func (d FeedDiff) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
+
+// One row per added or removed product and per changed field.
+func (d FeedDiff) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"sku", "change", "field", "old", "new", "percent"})
+	for _, product := range d.Added {
+		writer.Write([]string{product.SKU, "added", "", "", product.Name, ""})
+	}
+	for _, product := range d.Removed {
+		writer.Write([]string{product.SKU, "removed", "", product.Name, "", ""})
+	}
+	for _, product := range d.Changed {
+		for _, change := range product.Changes {
+			percent := ""
+			if change.Percent != nil {
+				percent = fmt.Sprintf("%.2f", *change.Percent)
+			}
+			writer.Write([]string{product.SKU, "changed", change.Field, change.Old, change.New, percent})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
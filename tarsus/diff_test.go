@@ -0,0 +1,143 @@
+package tarsus
+
+import (
+	"errors"
+	"iter"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+)
+
+func decodeString(products string) iter.Seq2[types.TarsusProduct, error] {
+	return Decode(strings.NewReader(`{"products": [` + products + `]}`))
+}
+
+func skus(summaries []ProductSummary) []string {
+	skus := make([]string, len(summaries))
+	for i, summary := range summaries {
+		skus[i] = summary.SKU
+	}
+	return skus
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		old, new    string
+		wantAdded   []string
+		wantRemoved []string
+		// SKU and changed fields
+		wantChanged map[string][]string
+	}{
+		{"unchanged",
+			`{"Product_Number": "A1", "Price_ex_Vat": 10, "Available_Stock": 2}`,
+			`{"Product_Number": "A1", "Price_ex_Vat": 10.00, "Available_Stock": 2}`,
+			[]string{}, []string{}, map[string][]string{}},
+		{"added and removed",
+			`{"Product_Number": "A1"}, {"Product_Number": "B1"}`,
+			`{"Product_Number": "C1"}, {"Product_Number": "A1"}, {"Product_Number": "B0"}`,
+			[]string{"B0", "C1"}, []string{"B1"}, map[string][]string{}},
+		{"changed fields",
+			`{"Product_Number": "A1", "Price_ex_Vat": 10, "Available_Stock": 2, "Product_Discounted": "no", "ETA_Date": null}`,
+			`{"Product_Number": "A1", "Price_ex_Vat": 12, "Available_Stock": 0, "Product_Discounted": "Yes", "ETA_Date": "2026-03-01T00:00:00"}`,
+			[]string{}, []string{},
+			map[string][]string{"A1": {"Price_ex_Vat", "Available_Stock", "ETA_Date", "Product_Discounted"}}},
+		{"first of duplicate SKUs is compared",
+			`{"Product_Number": "A1", "Image_URL": "a.jpg"}, {"Product_Number": "A1", "Image_URL": "b.jpg"}`,
+			`{"Product_Number": "A1", "Image_URL": "a.jpg"}, {"Product_Number": "A1", "Image_URL": "c.jpg"}`,
+			[]string{}, []string{}, map[string][]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff, err := Diff(decodeString(test.old), decodeString(test.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := skus(diff.Added); !slices.Equal(got, test.wantAdded) {
+				t.Errorf("added %q, want %q", got, test.wantAdded)
+			}
+			if got := skus(diff.Removed); !slices.Equal(got, test.wantRemoved) {
+				t.Errorf("removed %q, want %q", got, test.wantRemoved)
+			}
+			if len(diff.Changed) != len(test.wantChanged) {
+				t.Fatalf("changed %+v, want %v", diff.Changed, test.wantChanged)
+			}
+			for _, product := range diff.Changed {
+				fields := make([]string, len(product.Changes))
+				for i, change := range product.Changes {
+					fields[i] = change.Field
+				}
+				if want := test.wantChanged[product.SKU]; !slices.Equal(fields, want) {
+					t.Errorf("%s changed %q, want %q", product.SKU, fields, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffFeedError(t *testing.T) {
+	broken := decodeString(`{"Product_Number": "A1", "Price_ex_Vat": "free"}`)
+	if _, err := Diff(decodeString(`{"Product_Number": "A1"}`), broken); err == nil {
+		t.Error("no error for a broken new feed")
+	}
+	failing := func(yield func(types.TarsusProduct, error) bool) {
+		yield(types.TarsusProduct{}, errors.New("truncated"))
+	}
+	if _, err := Diff(failing, decodeString(``)); err == nil || !strings.HasPrefix(err.Error(), "old feed") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestPriceChange(t *testing.T) {
+	tests := []struct {
+		old, new    types.PriceString
+		wantChange  bool
+		wantPercent float64 // NaN for no percentage
+	}{
+		{"100", "100.00", false, math.NaN()},
+		{"100", "125", true, 25},
+		{"80", "60", true, -25},
+		{"0", "10", true, math.NaN()},
+		{"", "10", true, math.NaN()},
+		{"", "", false, math.NaN()},
+	}
+	for _, test := range tests {
+		t.Run(string(test.old)+"->"+string(test.new), func(t *testing.T) {
+			change, ok := priceChange("Price_ex_Vat", test.old, test.new)
+			if ok != test.wantChange {
+				t.Fatalf("changed = %v, want %v", ok, test.wantChange)
+			}
+			switch {
+			case math.IsNaN(test.wantPercent) && change.Percent != nil:
+				t.Errorf("percent = %v, want none", *change.Percent)
+			case !math.IsNaN(test.wantPercent) && (change.Percent == nil || math.Abs(*change.Percent-test.wantPercent) > 1e-9):
+				t.Errorf("percent = %v, want %v", change.Percent, test.wantPercent)
+			}
+		})
+	}
+}
+
+func TestShorten(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a longer description", 8, "a longer..."},
+		{"  spread \n over\tlines ", 20, "spread over lines"},
+		{"Kaffeemaschine für Büros", 17, "Kaffeemaschine fü..."},
+		{"Écran 27\" 4K — ÜBER", 13, "Écran 27\" 4K ..."},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			if got := shorten(test.in, test.n); got != test.want {
+				t.Errorf("shorten(%q, %d) = %q, want %q", test.in, test.n, got, test.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package types
 
+import "github.com/RoundRobinHood/jouma-data-migration/rest"
+
 type ApiConfig struct {
 	BaseUrl string
-	APIKey  string
+	Auth    rest.Authenticator
 }
@@ -3,3 +3,46 @@ package types
 type WPImage struct {
 	ID int `json:"id"`
 }
+
+type WPRendered struct {
+	// Only sent in edit context
+	Raw      string `json:"raw"`
+	Rendered string `json:"rendered"`
+}
+
+type WPMediaSize struct {
+	Filesize  int64  `json:"filesize"`
+	SourceURL string `json:"source_url"`
+}
+
+type WPMediaDetails struct {
+	Filesize int64                  `json:"filesize"`
+	Sizes    map[string]WPMediaSize `json:"sizes"`
+}
+
+type WPMedia struct {
+	ID           int            `json:"id"`
+	Author       int            `json:"author"`
+	Post         int            `json:"post"`
+	Title        WPRendered     `json:"title"`
+	AltText      string         `json:"alt_text"`
+	Caption      WPRendered     `json:"caption"`
+	MediaType    string         `json:"media_type"`
+	MimeType     string         `json:"mime_type"`
+	SourceURL    string         `json:"source_url"`
+	Description  WPRendered     `json:"description"`
+	MediaDetails WPMediaDetails `json:"media_details"`
+}
+
+type WPUser struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type WPMediaUpdate struct {
+	AltText string `json:"alt_text,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	// Only written by wc.MarkMedia
+	Description string `json:"description,omitempty"`
+}
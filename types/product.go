@@ -3,6 +3,7 @@ package types
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -30,6 +31,12 @@ func (p PriceString) MarshalJSON() ([]byte, error) {
 	return []byte(p), nil
 }
 
+func (p PriceString) Float() (float64, bool) {
+	var value float64
+	_, err := fmt.Sscan(string(p), &value)
+	return value, err == nil
+}
+
 type ZonelessTimestamp struct {
 	Time *time.Time
 }
@@ -103,6 +110,65 @@ type TarsusProduct struct {
 	Weight         float64           `json:"Each_Weight"`
 }
 
+func (p TarsusProduct) Product() Product {
+	return Product{
+		Supplier:     "tarsus",
+		SKU:          p.ProductNumber,
+		PartNumber:   p.PartNr,
+		Barcode:      p.BarCode,
+		Name:         p.ShortDesc,
+		Description:  p.Description,
+		ProductType:  p.ProductType,
+		Manufacturer: p.Manufacturer,
+		Category:     p.Category,
+		Stock:        p.Stock,
+		Price:        p.PriceExVAT,
+		ListPrice:    p.RealPriceExVat,
+		ImageURL:     p.ImageURL,
+		ETA:          p.ETADate.Time,
+		Discounted:   bool(p.Discounted),
+		Width:        p.Width,
+		Height:       p.Height,
+		Length:       p.Length,
+		Weight:       p.Weight,
+	}
+}
+
+// A supplier's product, independent of the feed it came from. Prices are ex
+// VAT.
+type Product struct {
+	// Name of the source the product was read from
+	Supplier string
+	SKU      string
+	// The winning supplier's own SKU, set when offers are merged. SKU may
+	// belong to another supplier.
+	SupplierSKU  string
+	PartNumber   string
+	Barcode      string
+	Name         string
+	Description  string
+	ProductType  string
+	Manufacturer string
+	Category     string
+	Stock        int
+	Price        PriceString
+	// Price before discounts
+	ListPrice  PriceString
+	ImageURL   string
+	ETA        *time.Time
+	Discounted bool
+	Width      float64
+	Height     float64
+	Length     float64
+	Weight     float64
+}
+
+// Tarsus names, so media templates written against the Tarsus feed keep
+// working.
+func (p Product) ProductNumber() string { return p.SKU }
+func (p Product) PartNr() string        { return p.PartNumber }
+func (p Product) ShortDesc() string     { return p.Name }
+
 type WCTag struct {
 	Id   int    `json:"id,omitempty"`
 	Name string `json:"name,omitempty"`
@@ -121,6 +187,12 @@ type WCImage struct {
 	Name string `json:"name,omitempty"`
 }
 
+type WCMetaData struct {
+	ID    int    `json:"id,omitempty"`
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
 type WCDimensions struct {
 	Length string `json:"length"`
 	Width  string `json:"width"`
@@ -132,6 +204,7 @@ type WooCommerceProduct struct {
 	SKU          string        `json:"sku,omitempty"`
 	Name         string        `json:"name,omitempty"`
 	Slug         string        `json:"slug,omitempty"`
+	Status       string        `json:"status,omitempty"`
 	Description  string        `json:"description,omitempty"`
 	Tags         []WCTag       `json:"tags,omitempty"`
 	ProductType  string        `json:"type,omitempty"`
@@ -141,6 +214,7 @@ type WooCommerceProduct struct {
 	Images       []WCImage     `json:"images,omitempty"`
 	Dimensions   *WCDimensions `json:"dimensions,omitempty"`
 	Weight       string        `json:"weight,omitempty"`
+	MetaData     []WCMetaData  `json:"meta_data,omitempty"`
 }
 
 type WCProductResponse struct {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/RoundRobinHood/jouma-data-migration/supplier"
+)
+
+func runValidate(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	report := flags.String("report", "", "Write the JSON report to this file ('-' for stdout)")
+	csvConfig := flags.String("csv-config", "", "Read the feed as CSV, mapped to products by this JSON config")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: validate [flags] [feed file, default data.json]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	path := "data.json"
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	kind := "file"
+	if *csvConfig != "" {
+		kind = "csv"
+	}
+	src, err := feedSource(kind, path, *csvConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid source:", err)
+		os.Exit(1)
+	}
+
+	validator := supplier.NewValidator()
+	for _, err := range validator.Filter(src.Products()) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	result := validator.Report()
+	if *report == "-" {
+		supplier.WriteValidationReport("-", result)
+	} else {
+		supplier.PrintValidationSummary(result)
+		for _, issue := range result.Issues {
+			fmt.Printf("row %d\t%s\t%s\t%s: %s\n", issue.Row, issue.SKU, issue.Severity, issue.Code, issue.Message)
+		}
+		if *report != "" {
+			if err := supplier.WriteValidationReport(*report, result); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write report to %q: %v\n", *report, err)
+				os.Exit(1)
+			}
+		}
+	}
+	if result.Excluded > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,28 +1,53 @@
 package wc
 
 import (
+	"context"
 	"fmt"
+	"html"
+	"strings"
 
 	"github.com/RoundRobinHood/jouma-data-migration/rest"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
 )
 
-func GetAllCategories(WCCnf types.ApiConfig) ([]types.WCCategory, error) {
-	shouldRetry := true
-	var categories []types.WCCategory
-	resp, err := wc_client.Request(WCCnf.BaseUrl+"/wp-json/wc/v3/products/categories?per_page=100", &rest.RequestOptions{
-		Method:           "GET",
-		Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-		WithNetworkRetry: shouldRetry,
-	}, &categories)
+var CategoriesPerRequest = 100
 
+func GetAllCategories(ctx context.Context, WCCnf types.ApiConfig) ([]types.WCCategory, error) {
+	categories := make([]types.WCCategory, 0)
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/wp-json/wc/v3/products/categories?per_page=%d&page=%d", WCCnf.BaseUrl, CategoriesPerRequest, page)
+		var response []types.WCCategory
+		resp, err := wc_client.Request(ctx, url, &rest.RequestOptions{
+			Method: "GET",
+			Auth:   WCCnf.Auth,
+		}, &response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve categories: %w", err)
+		}
+
+		categories = append(categories, response...)
+
+		var totalPages int
+		fmt.Sscan(resp.Header.Get("X-WP-TotalPages"), &totalPages)
+		if page >= totalPages || len(response) == 0 {
+			return categories, nil
+		}
+	}
+}
+
+// Maps category names to their IDs on the store. Names are matched
+// case-insensitively, and WooCommerce returns them HTML-escaped.
+func CategoryIDs(ctx context.Context, WCCnf types.ApiConfig) (map[string]int, error) {
+	categories, err := GetAllCategories(ctx, WCCnf)
 	if err != nil {
 		return nil, err
 	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Unexpected StatusCode from retrieving categories: %d", resp.StatusCode)
+	ids := map[string]int{}
+	for _, category := range categories {
+		name := strings.ToLower(html.UnescapeString(category.Name))
+		if _, ok := ids[name]; !ok {
+			ids[name] = category.Id
+		}
 	}
-
-	return categories, nil
+	return ids, nil
 }
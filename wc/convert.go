@@ -1,19 +1,47 @@
 package wc
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"math"
 
-	"github.com/RoundRobinHood/jouma-data-migration/rest"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
-	"github.com/RoundRobinHood/jouma-data-migration/wp"
 )
 
-func FromTarsusProduct(product types.TarsusProduct, WPCnf types.ApiConfig) (types.WooCommerceProduct, error) {
+// Visible in the product's custom fields, for purchasing
+const (
+	SupplierMetaKey    = "supplier"
+	SupplierSKUMetaKey = "supplier_sku"
+)
+
+// When set, the winning supplier of each product is stored in its meta data.
+var TrackSuppliers = false
+
+func SupplierMeta(product types.Product) []types.WCMetaData {
+	sku := product.SupplierSKU
+	if sku == "" {
+		sku = product.SKU
+	}
+	return []types.WCMetaData{
+		{Key: SupplierMetaKey, Value: product.Supplier},
+		{Key: SupplierSKUMetaKey, Value: sku},
+	}
+}
+
+// Reports whether the supplier recorded on a WC product is out of date.
+func SupplierChanged(wc types.WooCommerceProduct, product types.Product) bool {
+	for _, meta := range SupplierMeta(product) {
+		if GetMeta(wc, meta.Key) != meta.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func FromProduct(ctx context.Context, product types.Product, WPCnf types.ApiConfig) (types.WooCommerceProduct, error) {
 	ret := types.WooCommerceProduct{
-		SKU:         product.ProductNumber,
-		Name:        product.ShortDesc,
+		SKU:         product.SKU,
+		Name:        product.Name,
 		Description: product.Description,
 		Tags: []types.WCTag{
 			{Name: product.ProductType},
@@ -23,7 +51,7 @@ func FromTarsusProduct(product types.TarsusProduct, WPCnf types.ApiConfig) (type
 			{Name: product.Category},
 		},
 		StockQtty:    product.Stock,
-		RegularPrice: string(product.PriceExVAT),
+		RegularPrice: string(product.Price),
 		Images:       make([]types.WCImage, 0),
 		Dimensions: &types.WCDimensions{
 			Width:  fmt.Sprint(product.Width),
@@ -31,37 +59,51 @@ func FromTarsusProduct(product types.TarsusProduct, WPCnf types.ApiConfig) (type
 		},
 		Weight: fmt.Sprint(product.Weight),
 	}
-	if product.ImageURL != "" {
-		resp, err := rest.Request(product.ImageURL, &rest.RequestOptions{Method: "HEAD", WithNetworkRetry: true}, nil, nil)
+	// Pinned images replace whatever is resolved here
+	if product.ImageURL != "" && !ImagesPinned(product.SKU) {
+		image, ok, err := ResolveImage(ctx, WPCnf, product.ImageURL, true)
 		if err != nil {
-			return ret, fmt.Errorf("failed to verify image URL: %w", err)
+			return ret, err
 		}
-		if resp.StatusCode == 200 {
-			id, err := wp.GetImageID(WPCnf, product.ImageURL)
-			if err != nil {
-				if errors.Is(err, wp.ErrImageNotExist) {
-					ret.Images = append(ret.Images, types.WCImage{Href: product.ImageURL})
-				} else {
-					return ret, fmt.Errorf("failed to check for image existence on WP: %w", err)
+		if ok {
+			hash := ""
+			if TrackImageHashes {
+				if hash, err = ImageHash(ctx, product.ImageURL); err != nil {
+					return ret, fmt.Errorf("failed to hash image: %w", err)
 				}
-			} else {
-				ret.Images = append(ret.Images, types.WCImage{Id: id})
 			}
+			ret.Images = append(ret.Images, image)
+			ret.MetaData = ImageMeta(product.ImageURL, hash)
+		}
+	}
+	if len(ret.Images) == 0 {
+		if id := Placeholder(product.Manufacturer); id != 0 {
+			ret.Images = append(ret.Images, types.WCImage{Id: id})
 		}
 	}
+	if TrackSuppliers {
+		ret.MetaData = append(ret.MetaData, SupplierMeta(product)...)
+	}
 	return ret, nil
 }
 
-func ConvertEquals(wc types.WooCommerceProduct, ts types.TarsusProduct) bool {
+// Reports whether a WC product matches what product converts to. Fields
+// pinned by an override belong to the shop and are not compared.
+func ConvertEquals(wc types.WooCommerceProduct, product types.Product) bool {
+	override := Overrides[product.SKU]
+
 	// Exact eq strings
-	if wc.SKU != ts.ProductNumber || wc.Name != ts.ShortDesc ||
-		wc.Description != ts.Description || wc.StockQtty != ts.Stock {
+	if wc.SKU != product.SKU || wc.StockQtty != product.Stock {
+		return false
+	}
+	if (override.Name == nil && wc.Name != product.Name) ||
+		(override.Description == nil && wc.Description != product.Description) {
 		return false
 	}
 
-	var wc_regular_price, ts_price_exVat, wc_width, wc_height, wc_length, wc_weight float64
+	var wc_regular_price, price, wc_width, wc_height, wc_length, wc_weight float64
 	fmt.Sscan(wc.RegularPrice, &wc_regular_price)
-	fmt.Sscan(string(ts.PriceExVAT), &ts_price_exVat)
+	fmt.Sscan(string(product.Price), &price)
 	fmt.Sscan(wc.Dimensions.Width, &wc_width)
 	fmt.Sscan(wc.Dimensions.Height, &wc_height)
 	fmt.Sscan(wc.Dimensions.Length, &wc_length)
@@ -69,9 +111,9 @@ func ConvertEquals(wc types.WooCommerceProduct, ts types.TarsusProduct) bool {
 
 	cmp_epsilon := float64(0.00001)
 	// Exact eq floats
-	if wc_regular_price != ts_price_exVat || math.Abs(wc_weight-ts.Weight) > cmp_epsilon ||
-		math.Abs(wc_length-ts.Length) > cmp_epsilon || math.Abs(wc_width-ts.Width) > cmp_epsilon ||
-		math.Abs(wc_height-ts.Height) > cmp_epsilon {
+	if (override.Price == nil && wc_regular_price != price) || math.Abs(wc_weight-product.Weight) > cmp_epsilon ||
+		math.Abs(wc_length-product.Length) > cmp_epsilon || math.Abs(wc_width-product.Width) > cmp_epsilon ||
+		math.Abs(wc_height-product.Height) > cmp_epsilon {
 		return false
 	}
 
@@ -81,10 +123,10 @@ func ConvertEquals(wc types.WooCommerceProduct, ts types.TarsusProduct) bool {
 
 	hasProductType, hasManufacturer := false, false
 	for _, tag := range wc.Tags {
-		if tag.Name == ts.ProductType {
+		if tag.Name == product.ProductType {
 			hasProductType = true
 		}
-		if tag.Name == ts.Manufacturer {
+		if tag.Name == product.Manufacturer {
 			hasManufacturer = true
 		}
 	}
@@ -93,11 +135,11 @@ func ConvertEquals(wc types.WooCommerceProduct, ts types.TarsusProduct) bool {
 		return false
 	}
 
-	if len(wc.Images) != 1 || wc.Images[0].Href != ts.ImageURL {
+	if override.Images == nil && (len(wc.Images) == 0 || ImageChanged(wc, product.ImageURL)) {
 		return false
 	}
 
-	if len(wc.Categories) != 1 || wc.Categories[0].Name != ts.Category {
+	if override.Categories == nil && (len(wc.Categories) != 1 || wc.Categories[0].Name != product.Category) {
 		return false
 	}
 
@@ -0,0 +1,187 @@
+package wc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoundRobinHood/jouma-data-migration/rest"
+)
+
+type ImageStatus string
+
+const (
+	ImageOK       ImageStatus = "ok"
+	ImageMissing  ImageStatus = "missing"
+	ImageNotFound ImageStatus = "not_found"
+	ImageBroken   ImageStatus = "broken"
+	ImageTimeout  ImageStatus = "timeout"
+	ImageNotImage ImageStatus = "not_image"
+	ImageTiny     ImageStatus = "tiny"
+)
+
+type ImageCheck struct {
+	URL         string      `json:"url"`
+	Status      ImageStatus `json:"status"`
+	StatusCode  int         `json:"status_code,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+	Size        int64       `json:"size,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// Images smaller than this many bytes are reported as tiny and not used.
+// Zero disables the check.
+var MinImageSize int64 = 0
+
+// Media IDs to use when a product has no usable image, by lower-case
+// manufacturer name. PlaceholderImage is used for everyone else.
+var PlaceholderImages = map[string]int{}
+var PlaceholderImage = 0
+
+var imageCheckClient = rest.NewClient(20 * time.Second)
+
+var imageChecks = map[string]ImageCheck{}
+var imageChecksLock sync.Mutex
+
+func Placeholder(manufacturer string) int {
+	if id, ok := PlaceholderImages[strings.ToLower(manufacturer)]; ok {
+		return id
+	}
+	return PlaceholderImage
+}
+
+func IsPlaceholder(id int) bool {
+	if id == 0 {
+		return false
+	}
+	if id == PlaceholderImage {
+		return true
+	}
+	for _, placeholder := range PlaceholderImages {
+		if placeholder == id {
+			return true
+		}
+	}
+	return false
+}
+
+// HEADs source and classifies the result. Results are cached for the
+// lifetime of the process, except timeouts, which are checked again next time.
+func CheckImage(ctx context.Context, source string) ImageCheck {
+	if source == "" {
+		return ImageCheck{Status: ImageMissing}
+	}
+
+	imageChecksLock.Lock()
+	check, ok := imageChecks[source]
+	imageChecksLock.Unlock()
+	if ok {
+		return check
+	}
+
+	check = headImage(ctx, source)
+	// A cancelled or timed out check says nothing lasting about the image
+	if ctx.Err() != nil || check.Status == ImageTimeout {
+		return check
+	}
+
+	imageChecksLock.Lock()
+	imageChecks[source] = check
+	imageChecksLock.Unlock()
+	return check
+}
+
+// Checks many images concurrently, filling the cache used by CheckImage.
+func CheckImages(ctx context.Context, sources []string, workerCount int) {
+	sourceChannel := make(chan string, 0)
+	go func() {
+		defer close(sourceChannel)
+		seen := map[string]struct{}{}
+		for _, source := range sources {
+			if _, ok := seen[source]; ok || source == "" {
+				continue
+			}
+			seen[source] = struct{}{}
+			select {
+			case sourceChannel <- source:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(workerCount)
+	for range workerCount {
+		go func() {
+			defer wg.Done()
+			for source := range sourceChannel {
+				CheckImage(ctx, source)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Statuses from servers that don't answer HEAD requests properly
+var headUnsupported = map[int]bool{403: true, 405: true, 501: true}
+
+func headImage(ctx context.Context, source string) ImageCheck {
+	check := ImageCheck{URL: source}
+	resp, err := rest.Request(ctx, source, &rest.RequestOptions{Method: "HEAD", Retry: rest.DefaultRetryPolicy()}, nil, imageCheckClient)
+	if errors.Is(err, rest.ErrAPI) && headUnsupported[resp.StatusCode] {
+		// Asks for the first byte only. The size comes from Content-Range.
+		resp, err = rest.Request(ctx, source, &rest.RequestOptions{
+			Method:  "GET",
+			Headers: map[string]string{"Range": "bytes=0-0"},
+			Retry:   rest.DefaultRetryPolicy(),
+		}, nil, imageCheckClient)
+	}
+	// Error statuses are classified below
+	if err != nil && !errors.Is(err, rest.ErrAPI) {
+		check.Status = ImageBroken
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			check.Status = ImageTimeout
+		}
+		check.Error = err.Error()
+		return check
+	}
+
+	check.StatusCode = resp.StatusCode
+	check.ContentType = resp.Header.Get("Content-Type")
+	check.Size = -1
+	if length := resp.Header.Get("Content-Length"); length != "" {
+		if size, err := strconv.ParseInt(length, 10, 64); err == nil {
+			check.Size = size
+		}
+	}
+	if resp.StatusCode == 206 {
+		// "bytes 0-0/12345", where the total may be "*"
+		check.Size = -1
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i != -1 {
+			if size, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				check.Size = size
+			}
+		}
+	}
+
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		check.Status = ImageNotFound
+	case resp.StatusCode != 200 && resp.StatusCode != 206:
+		check.Status = ImageBroken
+	case check.ContentType != "" && !strings.HasPrefix(strings.ToLower(check.ContentType), "image/"):
+		check.Status = ImageNotImage
+	case check.Size >= 0 && check.Size < MinImageSize:
+		check.Status = ImageTiny
+	default:
+		check.Status = ImageOK
+	}
+	return check
+}
@@ -0,0 +1,197 @@
+package wc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/RoundRobinHood/jouma-data-migration/images"
+	"github.com/RoundRobinHood/jouma-data-migration/rest"
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wp"
+)
+
+const (
+	ImageURLMetaKey  = "_tarsus_image_url"
+	ImageHashMetaKey = "_tarsus_image_hash"
+)
+
+// When set, the content hash of each product image is stored on creation,
+// so that later syncs can detect an image changing behind the same URL.
+var TrackImageHashes = false
+
+func GetMeta(product types.WooCommerceProduct, key string) string {
+	for _, meta := range product.MetaData {
+		if meta.Key == key {
+			if s, ok := meta.Value.(string); ok {
+				return s
+			}
+			return fmt.Sprint(meta.Value)
+		}
+	}
+	return ""
+}
+
+// The last image downloaded, so that hashing and uploading the same image
+// only fetches it once
+var lastImage struct {
+	sync.Mutex
+	source string
+	data   []byte
+}
+
+func downloadImage(ctx context.Context, source string) ([]byte, error) {
+	lastImage.Lock()
+	if lastImage.source == source {
+		data := lastImage.data
+		lastImage.Unlock()
+		return data, nil
+	}
+	lastImage.Unlock()
+
+	resp, err := rest.Request(ctx, source, &rest.RequestOptions{Method: "GET", Retry: rest.DefaultRetryPolicy()}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lastImage.Lock()
+	lastImage.source, lastImage.data = source, resp.Body
+	lastImage.Unlock()
+	return resp.Body, nil
+}
+
+func ImageHash(ctx context.Context, imageURL string) (string, error) {
+	data, err := downloadImage(ctx, imageURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download image: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Works out which image to send to WooCommerce for source. An existing media
+// item with the same file name is reused when reuse is set, otherwise the URL
+// is sent as-is for WooCommerce to sideload. ok is false if CheckImage does
+// not consider source usable.
+func ResolveImage(ctx context.Context, WPCnf types.ApiConfig, source string, reuse bool) (image types.WCImage, ok bool, err error) {
+	if CheckImage(ctx, source).Status != ImageOK {
+		return image, false, nil
+	}
+
+	if !reuse {
+		return uploadImage(ctx, WPCnf, source)
+	}
+
+	id, err := wp.GetImageID(ctx, WPCnf, source)
+	if err != nil {
+		if errors.Is(err, wp.ErrImageNotExist) {
+			return uploadImage(ctx, WPCnf, source)
+		}
+		return image, false, fmt.Errorf("failed to check for image existence on WP: %w", err)
+	}
+
+	return types.WCImage{Id: id}, true, nil
+}
+
+// When set, new images are downloaded, normalized and uploaded to the media
+// library by the sync instead of being sideloaded by WooCommerce.
+var ImageNormalization *images.Options
+
+func uploadImage(ctx context.Context, WPCnf types.ApiConfig, source string) (types.WCImage, bool, error) {
+	sideload := types.WCImage{Href: source}
+	if ImageNormalization == nil {
+		return sideload, true, nil
+	}
+
+	body, err := downloadImage(ctx, source)
+	if errors.Is(err, rest.ErrAPI) {
+		return sideload, false, nil
+	}
+	if err != nil {
+		return sideload, false, fmt.Errorf("failed to download image: %w", err)
+	}
+
+	data, contentType, err := images.Normalize(body, *ImageNormalization)
+	if err != nil {
+		fmt.Printf("WARNING: Could not normalize %q, leaving it to WooCommerce: %v\n", source, err)
+		return sideload, true, nil
+	}
+
+	name := path.Base(source)
+	if fileURL, err := url.Parse(source); err == nil {
+		name = path.Base(fileURL.Path)
+	}
+	name = strings.TrimSuffix(name, path.Ext(name)) + images.Extension(contentType)
+
+	media, err := wp.UploadMedia(ctx, WPCnf, name, contentType, data)
+	if err != nil {
+		return sideload, false, fmt.Errorf("failed to upload normalized image: %w", err)
+	}
+	if err := markMedia(ctx, WPCnf, media.ID, source); err != nil {
+		fmt.Println("WARNING:", err)
+	}
+	return types.WCImage{Id: media.ID}, true, nil
+}
+
+// Written to the description of attachments the sync added to the media
+// library, followed by the image's source URL. cleanup-media only considers
+// marked attachments unless told otherwise, so images uploaded by hand are
+// never removed.
+const MediaMarker = "Imported from supplier feed: "
+
+// Media IDs marked during this run
+var markedMedia = map[int]struct{}{}
+
+// Marks the featured image of a product the sync just created or updated, if
+// it was taken from source rather than pinned or a placeholder.
+func MarkMedia(ctx context.Context, WPCnf types.ApiConfig, product types.WooCommerceProduct, source string) error {
+	if len(product.Images) == 0 || source == "" || ImagesPinned(product.SKU) {
+		return nil
+	}
+	image := product.Images[0]
+	if image.Id == 0 || IsPlaceholder(image.Id) || !wp.SameImageFile(image.Href, source) {
+		return nil
+	}
+	return markMedia(ctx, WPCnf, image.Id, source)
+}
+
+func markMedia(ctx context.Context, WPCnf types.ApiConfig, id int, source string) error {
+	if _, ok := markedMedia[id]; ok {
+		return nil
+	}
+	markedMedia[id] = struct{}{}
+	if err := wp.UpdateMedia(ctx, WPCnf, id, types.WPMediaUpdate{Description: MediaMarker + source}); err != nil {
+		return fmt.Errorf("failed to mark media %d as imported: %w", id, err)
+	}
+	return nil
+}
+
+// Reports whether an attachment was added by the sync.
+func IsMarkedMedia(media types.WPMedia) bool {
+	return strings.Contains(media.Description.Rendered, MediaMarker)
+}
+
+func ImageMeta(source, hash string) []types.WCMetaData {
+	meta := []types.WCMetaData{{Key: ImageURLMetaKey, Value: source}}
+	if hash != "" {
+		meta = append(meta, types.WCMetaData{Key: ImageHashMetaKey, Value: hash})
+	}
+	return meta
+}
+
+// Reports whether the image on a WC product was taken from a different URL
+// than source. Products created before the source URL was recorded are
+// compared by file name instead.
+func ImageChanged(product types.WooCommerceProduct, source string) bool {
+	if stored := GetMeta(product, ImageURLMetaKey); stored != "" {
+		return stored != source
+	}
+	return len(product.Images) == 0 || !wp.SameImageFile(product.Images[0].Href, source)
+}
@@ -0,0 +1,159 @@
+package wc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/RoundRobinHood/jouma-data-migration/types"
+	"github.com/RoundRobinHood/jouma-data-migration/wp"
+)
+
+// Local values for a product that take precedence over its feed. Fields left
+// out follow the feed. Pinned fields are applied when the product is created
+// and restored on existing products whenever they differ.
+type Override struct {
+	Name        *string            `json:"name"`
+	Description *string            `json:"description"`
+	Price       *types.PriceString `json:"price"`
+	// Category names, resolved to IDs by ResolveOverrideCategories
+	Categories []string `json:"categories"`
+	// Media IDs or image URLs, the first being the featured image
+	Images []types.WCImage `json:"images"`
+
+	categoryIDs []int
+}
+
+// Pinned fields by SKU
+var Overrides = map[string]Override{}
+
+// Reports whether the images of the product with this SKU are pinned, so the
+// feed image must be left alone.
+func ImagesPinned(sku string) bool {
+	return Overrides[sku].Images != nil
+}
+
+// Looks up the IDs of pinned categories on the store. WooCommerce ignores
+// categories given by name only, so this must run before overrides are
+// applied. An unknown category is an error.
+func ResolveOverrideCategories(ctx context.Context, WCCnf types.ApiConfig) error {
+	var ids map[string]int
+	for sku, override := range Overrides {
+		if override.Categories == nil {
+			continue
+		}
+		if ids == nil {
+			var err error
+			if ids, err = CategoryIDs(ctx, WCCnf); err != nil {
+				return err
+			}
+		}
+		override.categoryIDs = make([]int, len(override.Categories))
+		for i, name := range override.Categories {
+			id, ok := ids[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				return fmt.Errorf("unknown category %q pinned for SKU %q", name, sku)
+			}
+			override.categoryIDs[i] = id
+		}
+		Overrides[sku] = override
+	}
+	return nil
+}
+
+func (o Override) categories() []types.WCCategory {
+	categories := make([]types.WCCategory, len(o.categoryIDs))
+	for i, id := range o.categoryIDs {
+		categories[i] = types.WCCategory{Id: id}
+	}
+	return categories
+}
+
+// Replaces the pinned fields of a converted product with their local values.
+func ApplyOverride(product types.WooCommerceProduct) types.WooCommerceProduct {
+	override, ok := Overrides[product.SKU]
+	if !ok {
+		return product
+	}
+	if override.Name != nil {
+		product.Name = *override.Name
+	}
+	if override.Description != nil {
+		product.Description = *override.Description
+	}
+	if override.Price != nil {
+		product.RegularPrice = string(*override.Price)
+	}
+	if override.Categories != nil {
+		product.Categories = override.categories()
+	}
+	if override.Images != nil {
+		product.Images = append([]types.WCImage{}, override.Images...)
+	}
+	return product
+}
+
+// Returns an update restoring the pinned fields of an existing WC product that
+// differ from their local values. ok is false if there is nothing to restore.
+func OverrideUpdate(product types.WooCommerceProduct) (update types.WooCommerceProduct, ok bool) {
+	override, pinned := Overrides[product.SKU]
+	if !pinned {
+		return update, false
+	}
+	update.ID = product.ID
+	if override.Name != nil && product.Name != *override.Name {
+		update.Name, ok = *override.Name, true
+	}
+	if override.Description != nil && product.Description != *override.Description {
+		update.Description, ok = *override.Description, true
+	}
+	if override.Price != nil {
+		changed := product.RegularPrice != string(*override.Price)
+		if price, valid := override.Price.Float(); valid {
+			current, _ := types.PriceString(product.RegularPrice).Float()
+			changed = current != price
+		}
+		if changed {
+			update.RegularPrice, ok = string(*override.Price), true
+		}
+	}
+	if override.Categories != nil && !sameCategories(product.Categories, override.categoryIDs) {
+		update.Categories, ok = override.categories(), true
+	}
+	if override.Images != nil && !sameImages(product.Images, override.Images) {
+		update.Images, ok = append([]types.WCImage{}, override.Images...), true
+	}
+	return update, ok
+}
+
+func sameCategories(categories []types.WCCategory, ids []int) bool {
+	if len(categories) != len(ids) {
+		return false
+	}
+	have := map[int]struct{}{}
+	for _, category := range categories {
+		have[category.Id] = struct{}{}
+	}
+	for _, id := range ids {
+		if _, ok := have[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Pinned images given by URL match the media sideloaded from them.
+func sameImages(images, pinned []types.WCImage) bool {
+	if len(images) != len(pinned) {
+		return false
+	}
+	for i, image := range pinned {
+		if image.Id != 0 && images[i].Id != image.Id {
+			return false
+		}
+		if image.Id == 0 && !wp.SameImageFile(images[i].Href, image.Href) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,16 +1,16 @@
 package wc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
-	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/RoundRobinHood/jouma-data-migration/metrics"
 	"github.com/RoundRobinHood/jouma-data-migration/rest"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
 	"github.com/RoundRobinHood/jouma-data-migration/wp"
@@ -18,30 +18,18 @@ import (
 )
 
 var wc_client = rest.RestClient{
-	Client: &http.Client{},
+	Client:      rest.NewClient(0),
+	Retry:       rest.DefaultRetryPolicy(),
+	Limiter:     rest.SiteLimiter,
+	Concurrency: rest.SiteConcurrency,
+	Breaker:     rest.SiteBreaker,
 }
 
-func jitterSleep(rateLimited bool) {
-	jitter := time.Duration(rand.Intn(1000)) * time.Millisecond
-	if rateLimited {
-		jitter *= 4
-	}
-	time.Sleep(time.Second + jitter)
-}
-
-func GetItemCount(url string, opt *rest.RequestOptions) (int, error) {
-func_start:
-	resp, err := wc_client.Request(url, opt, nil)
+func GetItemCount(ctx context.Context, url string, opt *rest.RequestOptions) (int, error) {
+	resp, err := wc_client.Request(ctx, url, opt, nil)
 	if err != nil {
 		return 0, err
 	}
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 429 {
-			jitterSleep(true)
-			goto func_start
-		}
-		return 0, fmt.Errorf("Expected status 200, got %d", resp.StatusCode)
-	}
 	total_header := resp.Header.Get("X-WP-Total")
 	var total int
 	_, err = fmt.Sscan(total_header, &total)
@@ -52,133 +40,148 @@ func_start:
 	return total, nil
 }
 
-func SKUExists(WCCnf types.ApiConfig, SKU string) (bool, error) {
-func_start:
+func SKUExists(ctx context.Context, WCCnf types.ApiConfig, SKU string) (bool, error) {
 	var products []types.WooCommerceProduct
-	resp, err := wc_client.Request(WCCnf.BaseUrl+"/wp-json/wc/v3/products?sku="+url.QueryEscape(SKU), &rest.RequestOptions{
-		Method:           "GET",
-		Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-		WithNetworkRetry: true,
+	_, err := wc_client.Request(ctx, WCCnf.BaseUrl+"/wp-json/wc/v3/products?sku="+url.QueryEscape(SKU), &rest.RequestOptions{
+		Method: "GET",
+		Auth:   WCCnf.Auth,
 	}, &products)
 	if err != nil {
-		if resp.StatusCode == 429 {
-			fmt.Printf("Got 429 when checking for SKU (%q). Retrying...\n", SKU)
-			jitterSleep(true)
-			goto func_start
-		}
 		return false, fmt.Errorf("failed to check for sku: %w", err)
 	}
 
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf("unexpected statuscode: %d", resp.StatusCode)
-	}
-
 	return len(products) != 0, nil
 }
 
-func CreateProduct(WPCnf types.ApiConfig, WCCnf types.ApiConfig, product types.WooCommerceProduct) error {
-func_start:
-	fmt.Printf("Attempting to create product with SKU %q\n", product.SKU)
-	resp, err := wc_client.Request(WCCnf.BaseUrl+"/wp-json/wc/v3/products", &rest.RequestOptions{
-		Method:           "POST",
-		Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-		Body:             product,
-		WithNetworkRetry: true,
-	}, nil)
-
-	if err != nil {
-		return err
-	}
+// Handles the retries specific to product creation. A 504 usually means
+// WordPress was still sideloading the image, so the image is looked up and
+// sent by ID if it made it. An image upload error is retried without images.
+func createRetryHook(WPCnf types.ApiConfig) rest.RetryHook {
+	return func(ctx context.Context, attempt int, opt *rest.RequestOptions, resp rest.Response, err error) rest.RetryDecision {
+		product, ok := opt.Body.(types.WooCommerceProduct)
+		if err != nil || !ok {
+			return rest.RetryDefault
+		}
 
-	if resp.StatusCode != 201 {
-
-		if resp.StatusCode == 504 {
-			fmt.Println("Got 504.")
-			fmt.Println("Sleeping & checking if image made it onto the server...")
-			jitterSleep(false)
-			if len(product.Images) != 0 && product.Images[0].Href != "" {
-				id, err := wp.GetImageID(WPCnf, product.Images[0].Href)
-				if err != nil {
-					if !errors.Is(err, wp.ErrImageNotExist) {
-						return fmt.Errorf("failed to check if image exists: %w", err)
-					} else {
-						fmt.Println("Image not on server. Retrying 504 again.")
-					}
-				} else {
-					fmt.Println("Image already on server. Retrying with its ID...")
-					product.Images[0] = types.WCImage{Id: id}
+		switch resp.StatusCode {
+		case 504:
+			fmt.Println("Got 504. Checking if image made it onto the server...")
+			if len(product.Images) == 0 || product.Images[0].Href == "" {
+				return rest.RetryNow
+			}
+			id, err := wp.GetImageID(ctx, WPCnf, product.Images[0].Href)
+			if err != nil {
+				if !errors.Is(err, wp.ErrImageNotExist) {
+					fmt.Fprintf(os.Stderr, "Failed to check if image exists (SKU: %q): %v\n", product.SKU, err)
+					return rest.RetryStop
 				}
+				fmt.Println("Image not on server. Retrying 504 again.")
+				return rest.RetryNow
+			}
+			fmt.Println("Image already on server. Retrying with its ID...")
+			product.Images = slices.Clone(product.Images)
+			product.Images[0] = types.WCImage{Id: id}
+			opt.Body = product
+			return rest.RetryNow
+		case 400:
+			if resp.ErrorCode() == "woocommerce_product_image_upload_error" && len(product.Images) != 0 {
+				fmt.Fprintf(os.Stderr, "WARNING: Image error for product (SKU: %q). Resending POST without images\n", product.SKU)
+				product.Images = []types.WCImage{}
+				opt.Body = product
+				return rest.RetryNow
 			}
-			jitterSleep(true)
-			goto func_start
 		}
+		return rest.RetryDefault
+	}
+}
 
-		if resp.StatusCode == 429 {
-			fmt.Printf("Retrying product creation (SKU: %q)\n", product.SKU)
-			jitterSleep(true)
-			goto func_start
+func CreateProduct(ctx context.Context, WPCnf types.ApiConfig, WCCnf types.ApiConfig, product types.WooCommerceProduct) (types.WooCommerceProduct, error) {
+	var created types.WooCommerceProduct
+	fmt.Printf("Attempting to create product with SKU %q\n", product.SKU)
+	_, err := wc_client.Request(ctx, WCCnf.BaseUrl+"/wp-json/wc/v3/products", &rest.RequestOptions{
+		Method: "POST",
+		Auth:   WCCnf.Auth,
+		Body:   product,
+		Retry:  wc_client.Retry.WithHook(createRetryHook(WPCnf)),
+		// Sideloading a big image often times out the gateway while the
+		// create still goes through. The hook checks and retries these.
+		ExpectedStatuses: map[int]bool{504: true},
+		// A repeat of a create that did go through fails on the SKU, which is
+		// handled below
+		RetryNonIdempotent: true,
+		FinishInFlight:     true,
+	}, &created)
+
+	if rest.ErrorCode(err) == "product_invalid_sku" {
+		fmt.Printf("Invalid sku (%q), checking if product already exists...\n", product.SKU)
+		exists, checkErr := SKUExists(ctx, WCCnf, product.SKU)
+		if checkErr != nil {
+			return created, fmt.Errorf("failed to double-check if product (SKU: %q) already exists: %w", product.SKU, checkErr)
 		}
-		if resp.StatusCode == 400 {
-			var errResponse struct {
-				Code string `json:"code"`
-			}
-			fmt.Printf("Interpreting 400 response for product (SKU %q)\n", product.SKU)
-			if err := json.Unmarshal(resp.Body, &errResponse); err == nil {
-				if errResponse.Code == "woocommerce_product_image_upload_error" {
-					fmt.Fprintf(os.Stderr, "WARNING: Image error for product (SKU: %q). Resending POST without images\n", product.SKU)
-					product.Images = []types.WCImage{}
-					goto func_start
-				} else if errResponse.Code == "product_invalid_sku" {
-					fmt.Printf("Invalid sku (%q), checking if product already exists...\n", product.SKU)
-					exists, err := SKUExists(WCCnf, product.SKU)
-					if err != nil {
-						return fmt.Errorf("failed to double-check if product (SKU: %q) already exists: %w", product.SKU, err)
-					}
-
-					if exists {
-						return nil
-					} else {
-						return fmt.Errorf("invalid SKU (%q). Response body:\n%s\n", product.SKU, string(resp.Body))
-					}
-				}
-			}
+		if exists {
+			return created, nil
 		}
-		return fmt.Errorf("Unexpected status code: %d\nResponse body:\n%s\n", resp.StatusCode, string(resp.Body))
 	}
-	return nil
+	if err != nil {
+		return created, fmt.Errorf("failed to create product (SKU: %q): %w", product.SKU, err)
+	}
+	return created, nil
 }
 
-func UpdateProduct(WCCnf types.ApiConfig, product types.WooCommerceProduct) error {
+func UpdateProduct(ctx context.Context, WCCnf types.ApiConfig, product types.WooCommerceProduct) (types.WooCommerceProduct, error) {
 	url := WCCnf.BaseUrl + "/wp-json/wc/v3/products/" + fmt.Sprint(product.ID)
 	product.ID = 0
-	resp, err := wc_client.Request(url, &rest.RequestOptions{
-		Method:  "PUT",
-		Headers: map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-		Body:    product,
-	}, nil)
+	var updated types.WooCommerceProduct
+	_, err := wc_client.Request(ctx, url, &rest.RequestOptions{
+		Method:         "PUT",
+		Auth:           WCCnf.Auth,
+		Body:           product,
+		FinishInFlight: true,
+	}, &updated)
 
 	if err != nil {
-		return err
+		return updated, err
 	}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Unexpected status code: %d\nResponse body:\n%s\n", resp.StatusCode, string(resp.Body))
-	}
+	return updated, nil
+}
+
+// The fields a supplier change updates. Stock is sent even when zero.
+type supplierUpdate struct {
+	RegularPrice string             `json:"regular_price,omitempty"`
+	StockQtty    int                `json:"stock_quantity"`
+	MetaData     []types.WCMetaData `json:"meta_data"`
+}
 
-	return nil
+// Records the winning supplier of product on the WC product with this ID,
+// together with the price and stock of its offer, so that the recorded
+// supplier is always the one that set the published values. A pinned price is
+// left alone.
+func UpdateSupplier(ctx context.Context, WCCnf types.ApiConfig, id int, product types.Product) error {
+	update := supplierUpdate{StockQtty: product.Stock, MetaData: SupplierMeta(product)}
+	if Overrides[product.SKU].Price == nil {
+		update.RegularPrice = string(product.Price)
+	}
+	url := WCCnf.BaseUrl + "/wp-json/wc/v3/products/" + fmt.Sprint(id)
+	_, err := wc_client.Request(ctx, url, &rest.RequestOptions{
+		Method:         "PUT",
+		Auth:           WCCnf.Auth,
+		Body:           update,
+		FinishInFlight: true,
+	}, nil)
+	return err
 }
 
 var ProductsPerRequest = 100
 
-func GetAllProducts(WCCnf types.ApiConfig, workerCount int) (chan types.WooCommerceProduct, chan error) {
+func GetAllProducts(ctx context.Context, WCCnf types.ApiConfig, workerCount int) (chan types.WooCommerceProduct, chan error) {
 	infoUrl := WCCnf.BaseUrl + "/wp-json/wc/v3/products?per_page=1&orderby=id&order=asc&_=" + fmt.Sprint(time.Now().UnixMilli())
 	products, errors := make(chan types.WooCommerceProduct, 0), make(chan error, 0)
 
 	go func() {
-		product_count, err := GetItemCount(infoUrl, &rest.RequestOptions{
-			Method:           "GET",
-			WithNetworkRetry: true,
-			Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
+		product_count, err := GetItemCount(ctx, infoUrl, &rest.RequestOptions{
+			Method: "GET",
+			Auth:   WCCnf.Auth,
 		})
 		if err != nil {
 			go func() {
@@ -197,47 +200,40 @@ func GetAllProducts(WCCnf types.ApiConfig, workerCount int) (chan types.WooComme
 
 		pageChannel := make(chan int, 0)
 		go func() {
+			defer close(pageChannel)
 			for i := range pageCount {
-				pageChannel <- i + 1
+				select {
+				case pageChannel <- i + 1:
+				case <-ctx.Done():
+					return
+				}
 			}
-			close(pageChannel)
 		}()
 
 		wg := new(sync.WaitGroup)
 		wg.Add(workerCount)
 
-		jitterSleep(false)
 		for i := range workerCount {
 			go func(i int) {
 				defer wg.Done()
 				for page := range pageChannel {
-				retry:
 					url := fmt.Sprintf("%s/wp-json/wc/v3/products?per_page=%d&page=%d&orderby=id&order=asc&_=%d", WCCnf.BaseUrl, ProductsPerRequest, page, time.Now().UnixMilli())
 					var response_products []types.WooCommerceProduct
-					resp, err := wc_client.Request(url, &rest.RequestOptions{
-						Method:           "GET",
-						Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-						WithNetworkRetry: true,
-						RetryDelay:       time.Second,
+					_, err := wc_client.Request(ctx, url, &rest.RequestOptions{
+						Method: "GET",
+						Auth:   WCCnf.Auth,
 					}, &response_products)
 					if err != nil {
-						if resp.StatusCode == 429 {
-							fmt.Printf("Worker %d retrying: 429\n", i)
-							jitterSleep(true)
-							goto retry
+						if ctx.Err() != nil {
+							return
 						}
 						errors <- fmt.Errorf("Failed to fetch %q (killing worker %d): %w", url, i, err)
 						return
 					}
-					if resp.StatusCode != 200 {
-						errors <- fmt.Errorf("Wrong status code %d for product fetch URL %q, killing worker %d", resp.StatusCode, url, i)
-						return
-					}
 					for _, product := range response_products {
 						products <- product
 					}
 					bar.Increment()
-					jitterSleep(false)
 				}
 			}(i)
 		}
@@ -250,15 +246,14 @@ func GetAllProducts(WCCnf types.ApiConfig, workerCount int) (chan types.WooComme
 
 var TagsPerRequest = 100
 
-func GetAllTags(WCCnf types.ApiConfig, workerCount int) (chan types.WCTag, chan error) {
+func GetAllTags(ctx context.Context, WCCnf types.ApiConfig, workerCount int) (chan types.WCTag, chan error) {
 	infoUrl := WCCnf.BaseUrl + "/wp-json/wc/v3/products/tags?per_page=1"
 	tags, errors := make(chan types.WCTag, 0), make(chan error, 0)
 
 	go func() {
-		tag_count, err := GetItemCount(infoUrl, &rest.RequestOptions{
-			Method:           "GET",
-			WithNetworkRetry: true,
-			Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
+		tag_count, err := GetItemCount(ctx, infoUrl, &rest.RequestOptions{
+			Method: "GET",
+			Auth:   WCCnf.Auth,
 		})
 		if err != nil {
 			go func() {
@@ -273,10 +268,14 @@ func GetAllTags(WCCnf types.ApiConfig, workerCount int) (chan types.WCTag, chan
 
 		pageChannel := make(chan int, 0)
 		go func() {
+			defer close(pageChannel)
 			for i := range pageCount {
-				pageChannel <- i + 1
+				select {
+				case pageChannel <- i + 1:
+				case <-ctx.Done():
+					return
+				}
 			}
-			close(pageChannel)
 		}()
 
 		wg := new(sync.WaitGroup)
@@ -286,24 +285,18 @@ func GetAllTags(WCCnf types.ApiConfig, workerCount int) (chan types.WCTag, chan
 			go func(i int) {
 				defer wg.Done()
 				for page := range pageChannel {
-				retry:
 					url := fmt.Sprintf("%s/wp-json/wc/v3/products/tags?per_page=%d&page=%d", WCCnf.BaseUrl, TagsPerRequest, page)
 					var response_tags []types.WCTag
-					resp, err := wc_client.Request(url, &rest.RequestOptions{
-						Method:           "GET",
-						Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-						WithNetworkRetry: true,
+					_, err := wc_client.Request(ctx, url, &rest.RequestOptions{
+						Method: "GET",
+						Auth:   WCCnf.Auth,
+						Retry:  wc_client.Retry.WithStatuses(409),
 					}, &response_tags)
 					if err != nil {
-						errors <- fmt.Errorf("Failed to fetch %q (killing worker %d): %w", url, i, err)
-						return
-					}
-					if resp.StatusCode != 200 {
-						if resp.StatusCode == 409 {
-							jitterSleep(true)
-							goto retry
+						if ctx.Err() != nil {
+							return
 						}
-						errors <- fmt.Errorf("Wrong status code %d for %q (killing worker %d)", resp.StatusCode, url, i)
+						errors <- fmt.Errorf("Failed to fetch %q (killing worker %d): %w", url, i, err)
 						return
 					}
 					for _, tag := range response_tags {
@@ -321,17 +314,21 @@ func GetAllTags(WCCnf types.ApiConfig, workerCount int) (chan types.WCTag, chan
 	return tags, errors
 }
 
-func CreateProducts(WPCnf, WCCnf types.ApiConfig, Products []types.WooCommerceProduct, workerCount int) chan error {
+func CreateProducts(ctx context.Context, WPCnf, WCCnf types.ApiConfig, Products []types.WooCommerceProduct, workerCount int) (chan types.WooCommerceProduct, chan error) {
 	fmt.Printf("Creating %d products with %d workers", len(Products), workerCount)
 	productChannel := make(chan types.WooCommerceProduct, 0)
 	go func() {
+		defer close(productChannel)
 		for _, product := range Products {
-			productChannel <- product
+			select {
+			case productChannel <- product:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(productChannel)
 	}()
 
-	errors := make(chan error, 0)
+	created, errors := make(chan types.WooCommerceProduct, 0), make(chan error, 0)
 
 	go func() {
 		wg := new(sync.WaitGroup)
@@ -342,30 +339,73 @@ func CreateProducts(WPCnf, WCCnf types.ApiConfig, Products []types.WooCommercePr
 			go func(i int) {
 				defer wg.Done()
 				for product := range productChannel {
-					if err := CreateProduct(WPCnf, WCCnf, product); err != nil {
+					result, err := CreateProduct(ctx, WPCnf, WCCnf, product)
+					if err != nil {
+						if ctx.Err() != nil {
+							return
+						}
 						errors <- err
 						return
 					}
+					if result.ID != 0 {
+						created <- result
+					}
 					bar.Increment()
-					jitterSleep(false)
 				}
 			}(i)
 		}
 
 		wg.Wait()
+		close(created)
 		close(errors)
 	}()
 
-	return errors
+	return created, errors
+}
+
+func DeleteProducts(ctx context.Context, WCCnf types.ApiConfig, IDs []int, workerCount, maxBatch int) chan error {
+	return batchProducts(ctx, WCCnf, IDs, workerCount, maxBatch, "deleted", func(ids []int) map[string]any {
+		return map[string]any{"delete": ids}
+	})
 }
 
-func DeleteProducts(WCCnf types.ApiConfig, IDs []int, workerCount, maxBatch int) chan error {
+// Set on products the sync moved to draft, so they are published again when
+// they return to the feed. Products drafted by hand are left alone.
+const DraftedMetaKey = "_sync_drafted"
+
+// Sets the status of products in batches: "draft" for products that left the
+// feed, "publish" for drafted products that returned.
+func SetProductStatus(ctx context.Context, WCCnf types.ApiConfig, IDs []int, status string, workerCount, maxBatch int) chan error {
+	drafted, action := "", "published"
+	if status == "draft" {
+		drafted, action = "1", "drafted"
+	}
+	return batchProducts(ctx, WCCnf, IDs, workerCount, maxBatch, action, func(ids []int) map[string]any {
+		updates := make([]map[string]any, len(ids))
+		for i, id := range ids {
+			updates[i] = map[string]any{
+				"id":        id,
+				"status":    status,
+				"meta_data": []types.WCMetaData{{Key: DraftedMetaKey, Value: drafted}},
+			}
+		}
+		return map[string]any{"update": updates}
+	})
+}
+
+// Sends IDs to the batch endpoint, at most maxBatch per request, counting
+// them under action in metrics.Products. Every batch must be safe to repeat.
+func batchProducts(ctx context.Context, WCCnf types.ApiConfig, IDs []int, workerCount, maxBatch int, action string, body func(ids []int) map[string]any) chan error {
 	batchChannel := make(chan []int, 0)
 	go func() {
+		defer close(batchChannel)
 		for i := 0; i < len(IDs); i += maxBatch {
-			batchChannel <- IDs[i:min(i+maxBatch, len(IDs))]
+			select {
+			case batchChannel <- IDs[i:min(i+maxBatch, len(IDs))]:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(batchChannel)
 	}()
 
 	errors := make(chan error, 0)
@@ -381,32 +421,26 @@ func DeleteProducts(WCCnf types.ApiConfig, IDs []int, workerCount, maxBatch int)
 			go func(i int) {
 				defer wg.Done()
 				for ids := range batchChannel {
-				batch_start:
-					resp, err := wc_client.Request(url, &rest.RequestOptions{
-						Method:           "POST",
-						Headers:          map[string]string{"Authorization": "Basic " + WCCnf.APIKey},
-						Body:             map[string]any{"delete": ids},
-						WithNetworkRetry: true,
-						RetryDelay:       time.Second,
+					_, err := wc_client.Request(ctx, url, &rest.RequestOptions{
+						Method: "POST",
+						Auth:   WCCnf.Auth,
+						Body:   body(ids),
+						// Deleting the same IDs or setting the same status twice
+						// is harmless
+						RetryNonIdempotent: true,
+						FinishInFlight:     true,
 					}, nil)
 
 					if err != nil {
-						errors <- fmt.Errorf("delete request failed (killing worker %d", i)
-						return
-					}
-
-					if resp.StatusCode != 200 {
-						if resp.StatusCode == 429 {
-							errors <- fmt.Errorf("worker %d wait-retrying", i)
-							jitterSleep(true)
-							goto batch_start
+						if ctx.Err() != nil {
+							return
 						}
-						errors <- fmt.Errorf("unexpected statuscode %d (killing worker %d). Response body: \n%s\n", resp.StatusCode, i, string(resp.Body))
+						errors <- fmt.Errorf("batch request failed (killing worker %d): %w", i, err)
 						return
 					}
 
 					bar.Add(len(ids))
-					jitterSleep(false)
+					metrics.Products.Add(float64(len(ids)), action)
 				}
 			}(i)
 		}
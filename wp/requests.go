@@ -1,27 +1,30 @@
 package wp
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/RoundRobinHood/jouma-data-migration/rest"
 	"github.com/RoundRobinHood/jouma-data-migration/types"
 )
 
 var wp_client = &rest.RestClient{
-	Client: &http.Client{},
+	Client:      rest.NewClient(0),
+	Retry:       rest.DefaultRetryPolicy(),
+	Limiter:     rest.SiteLimiter,
+	Concurrency: rest.SiteConcurrency,
+	Breaker:     rest.SiteBreaker,
 }
 
 var ErrImageNotExist = errors.New("image does not exist")
 
-func GetImageID(WPCnf types.ApiConfig, source string) (int, error) {
-	sleep_seconds := 1
-func_start:
+func GetImageID(ctx context.Context, WPCnf types.ApiConfig, source string) (int, error) {
 	search := source
 	if strings.Contains(source, "/") {
 		fileURL, err := url.Parse(source)
@@ -32,31 +35,161 @@ func_start:
 	}
 	search = strings.TrimSuffix(search, path.Ext(search))
 
-	var response []types.WPImage
-	url := fmt.Sprintf("%s/wp-json/wp/v2/media?search=%s", WPCnf.BaseUrl, url.QueryEscape(search))
-	resp, err := wp_client.Request(url, &rest.RequestOptions{
-		Method:           "GET",
-		Headers:          map[string]string{"Authorization": "Basic " + WPCnf.APIKey},
-		WithNetworkRetry: true,
-		RetryDelay:       time.Second,
-	}, &response)
-	if err != nil {
-		if resp.StatusCode == 429 {
-			fmt.Printf("429 received from media request. Sleeping for %d seconds...\n", sleep_seconds)
-			time.Sleep(time.Second * time.Duration(sleep_seconds))
-			sleep_seconds *= 2
-			goto func_start
+	// The search also matches titles and longer file names, so the exact file
+	// may be on any page
+	for page := 1; ; page++ {
+		var response []types.WPMedia
+		url := fmt.Sprintf("%s/wp-json/wp/v2/media?search=%s&per_page=%d&page=%d", WPCnf.BaseUrl, url.QueryEscape(search), MediaPerRequest, page)
+		resp, err := wp_client.Request(ctx, url, &rest.RequestOptions{
+			Method: "GET",
+			Auth:   WPCnf.Auth,
+		}, &response)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, media := range response {
+			if SameImageFile(media.SourceURL, source) {
+				return media.ID, nil
+			}
+		}
+
+		var totalPages int
+		fmt.Sscan(resp.Header.Get("X-WP-TotalPages"), &totalPages)
+		if page >= totalPages || len(response) == 0 {
+			return 0, ErrImageNotExist
 		}
-		return 0, err
 	}
+}
 
-	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+func imageBaseName(source string) string {
+	name := source
+	if fileURL, err := url.Parse(source); err == nil {
+		name = path.Base(fileURL.Path)
 	}
+	return strings.ToLower(strings.TrimSuffix(name, path.Ext(name)))
+}
+
+// Suffixes WordPress adds to an uploaded file name: "-1" for duplicates,
+// "-300x200" for sizes and "-scaled" for big images
+var wpFileSuffixes = regexp.MustCompile(`^(-\d+|-\d+x\d+|-scaled)*$`)
 
-	if len(response) == 0 {
-		return 0, ErrImageNotExist
+// Reports whether a WordPress media URL looks like it was sideloaded from
+// source, allowing only the suffixes WordPress adds to the file name.
+func SameImageFile(mediaURL, source string) bool {
+	base := imageBaseName(source)
+	name := imageBaseName(mediaURL)
+	return base != "" && strings.HasPrefix(name, base) && wpFileSuffixes.MatchString(name[len(base):])
+}
+
+func DeleteMedia(ctx context.Context, WPCnf types.ApiConfig, id int) error {
+	url := fmt.Sprintf("%s/wp-json/wp/v2/media/%d?force=true", WPCnf.BaseUrl, id)
+	_, err := wp_client.Request(ctx, url, &rest.RequestOptions{
+		Method:         "DELETE",
+		Auth:           WPCnf.Auth,
+		FinishInFlight: true,
+	}, nil)
+	return err
+}
+
+func GetCurrentUser(ctx context.Context, WPCnf types.ApiConfig) (types.WPUser, error) {
+	var user types.WPUser
+	_, err := wp_client.Request(ctx, WPCnf.BaseUrl+"/wp-json/wp/v2/users/me", &rest.RequestOptions{
+		Method: "GET",
+		Auth:   WPCnf.Auth,
+	}, &user)
+	return user, err
+}
+
+var MediaPerRequest = 100
+
+// Lists all image attachments in the media library. If author is non-zero,
+// only attachments uploaded by that user are returned.
+func GetAllMedia(ctx context.Context, WPCnf types.ApiConfig, author int) ([]types.WPMedia, error) {
+	media := make([]types.WPMedia, 0)
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/wp-json/wp/v2/media?media_type=image&per_page=%d&page=%d&orderby=id&order=asc", WPCnf.BaseUrl, MediaPerRequest, page)
+		if author != 0 {
+			url += fmt.Sprintf("&author=%d", author)
+		}
+		var response []types.WPMedia
+		resp, err := wp_client.Request(ctx, url, &rest.RequestOptions{
+			Method: "GET",
+			Auth:   WPCnf.Auth,
+		}, &response)
+		if err != nil {
+			return media, err
+		}
+
+		media = append(media, response...)
+
+		var totalPages int
+		fmt.Sscan(resp.Header.Get("X-WP-TotalPages"), &totalPages)
+		if page >= totalPages || len(response) == 0 {
+			return media, nil
+		}
+	}
+}
+
+// Fetches attachments by ID in edit context, so that the raw text fields are
+// included. IDs that don't exist are left out.
+func GetMediaByID(ctx context.Context, WPCnf types.ApiConfig, ids []int) ([]types.WPMedia, error) {
+	media := make([]types.WPMedia, 0, len(ids))
+	for start := 0; start < len(ids); start += MediaPerRequest {
+		batch := ids[start:min(start+MediaPerRequest, len(ids))]
+		include := make([]string, len(batch))
+		for i, id := range batch {
+			include[i] = strconv.Itoa(id)
+		}
+		url := fmt.Sprintf("%s/wp-json/wp/v2/media?context=edit&per_page=%d&include=%s", WPCnf.BaseUrl, MediaPerRequest, strings.Join(include, ","))
+		var response []types.WPMedia
+		_, err := wp_client.Request(ctx, url, &rest.RequestOptions{
+			Method: "GET",
+			Auth:   WPCnf.Auth,
+		}, &response)
+		if err != nil {
+			return media, err
+		}
+		media = append(media, response...)
 	}
+	return media, nil
+}
+
+// Size on disk of an attachment, including its generated thumbnails.
+func MediaSize(media types.WPMedia) int64 {
+	size := media.MediaDetails.Filesize
+	for _, thumb := range media.MediaDetails.Sizes {
+		size += thumb.Filesize
+	}
+	return size
+}
 
-	return response[0].ID, nil
+func UpdateMedia(ctx context.Context, WPCnf types.ApiConfig, id int, update types.WPMediaUpdate) error {
+	url := fmt.Sprintf("%s/wp-json/wp/v2/media/%d", WPCnf.BaseUrl, id)
+	_, err := wp_client.Request(ctx, url, &rest.RequestOptions{
+		Method:             "POST",
+		Auth:               WPCnf.Auth,
+		Body:               update,
+		RetryNonIdempotent: true,
+		FinishInFlight:     true,
+	}, nil)
+	return err
+}
+
+func UploadMedia(ctx context.Context, WPCnf types.ApiConfig, filename, contentType string, data []byte) (types.WPImage, error) {
+	var media types.WPImage
+	_, err := wp_client.Request(ctx, WPCnf.BaseUrl+"/wp-json/wp/v2/media", &rest.RequestOptions{
+		Method: "POST",
+		Auth:   WPCnf.Auth,
+		Headers: map[string]string{
+			"Content-Type":        contentType,
+			"Content-Disposition": fmt.Sprintf("attachment; filename=%q", filename),
+		},
+		RawBody:        data,
+		FinishInFlight: true,
+	}, &media)
+	if err != nil {
+		return media, fmt.Errorf("failed to upload %q: %w", filename, err)
+	}
+	return media, nil
 }